@@ -0,0 +1,124 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"image"
+	"image/draw"
+	"math"
+
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+// --- Pixel Adjustments ---
+
+// toNRGBA returns a non-premultiplied copy of img, so per-pixel transforms
+// can work on colour channels independently of alpha.
+func toNRGBA(img image.Image) *image.NRGBA {
+	out := image.NewNRGBA(img.Bounds())
+	draw.Draw(out, out.Bounds(), img, img.Bounds().Min, draw.Src)
+	return out
+}
+
+// invertColors inverts the RGB channels of img, preserving alpha, for dark
+// themed and monochrome displays.
+func invertColors(img image.Image) image.Image {
+	out := toNRGBA(img)
+	for i := 0; i < len(out.Pix); i += 4 {
+		out.Pix[i] = 0xff - out.Pix[i]
+		out.Pix[i+1] = 0xff - out.Pix[i+1]
+		out.Pix[i+2] = 0xff - out.Pix[i+2]
+	}
+	return out
+}
+
+// scaleOpacity multiplies the alpha of every pixel by opacity, for blending
+// the whole tile under a client's own UI.
+func scaleOpacity(img image.Image, opacity float64) image.Image {
+	out := toNRGBA(img)
+	for i := 3; i < len(out.Pix); i += 4 {
+		out.Pix[i] = uint8(math.Round(float64(out.Pix[i]) * opacity))
+	}
+	return out
+}
+
+// MAX_CONTRAST is the largest accepted contrast factor.
+const MAX_CONTRAST = 4
+
+// adjustLevels applies brightness and contrast to the RGB channels of img,
+// preserving alpha. Channels are scaled by contrast about mid-grey, then
+// offset by brightness as a fraction of full scale. Neutral values are 0
+// and 1.
+func adjustLevels(img image.Image, brightness, contrast float64) image.Image {
+	var levels [256]uint8
+	for i := range levels {
+		v := (float64(i)/0xff-0.5)*contrast + 0.5 + brightness
+		levels[i] = uint8(math.Round(max(0, min(v, 1)) * 0xff))
+	}
+	out := toNRGBA(img)
+	for i := 0; i < len(out.Pix); i += 4 {
+		out.Pix[i] = levels[out.Pix[i]]
+		out.Pix[i+1] = levels[out.Pix[i+1]]
+		out.Pix[i+2] = levels[out.Pix[i+2]]
+	}
+	return out
+}
+
+// resizeTile scales img to a size pixel square, for layers such as the
+// basemap that only come at the standard tile size.
+func resizeTile(img image.Image, size int) image.Image {
+	if b := img.Bounds(); b.Dx() == size && b.Dy() == size {
+		return img
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	xdraw.BiLinear.Scale(dst, dst.Bounds(), img, img.Bounds(), xdraw.Src, nil)
+	return dst
+}
+
+// --- Rotation ---
+
+// rotatedFetchSize is the side of the square fetched for a rotated tile of
+// size pixels: the tile's diagonal, so no rotation leaves empty corners.
+func rotatedFetchSize(size int) int {
+	return int(math.Ceil(float64(size) * math.Sqrt2))
+}
+
+// bufferBounds grows a tile extent about its centre to cover
+// rotatedFetchSize pixels at the resolution of a size pixel tile.
+func bufferBounds(b [4]float64, size int) [4]float64 {
+	cx, cy := (b[0]+b[2])/2, (b[1]+b[3])/2
+	half := (b[2] - b[0]) / 2 * float64(rotatedFetchSize(size)) / float64(size)
+	return [4]float64{cx - half, cy - half, cx + half, cy + half}
+}
+
+// rotateToBearing rotates src about its centre so that bearing, in degrees
+// clockwise from north, points up, and crops the centre to a size pixel
+// tile.
+func rotateToBearing(src image.Image, bearing float64, size int) *image.NRGBA {
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	sin, cos := math.Sincos(bearing * math.Pi / 180)
+	sb := src.Bounds()
+	scx, scy := float64(sb.Min.X+sb.Max.X)/2, float64(sb.Min.Y+sb.Max.Y)/2
+	dc := float64(size) / 2
+	s2d := f64.Aff3{
+		cos, sin, dc - (cos*scx + sin*scy),
+		-sin, cos, dc - (-sin*scx + cos*scy),
+	}
+	xdraw.BiLinear.Transform(dst, s2d, src, sb, xdraw.Src, nil)
+	return dst
+}
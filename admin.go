@@ -0,0 +1,206 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Admin Endpoints ---
+
+// requireAdmin wraps a handler so it only runs for requests carrying the
+// configured admin token as a bearer credential.
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.AdminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// probeResult reports how long each phase of an upstream tile fetch took.
+type probeResult struct {
+	URL       string  `json:"url"`
+	Status    int     `json:"status"`
+	Bytes     int     `json:"bytes"`
+	DNSMs     float64 `json:"dnsMs"`
+	ConnectMs float64 `json:"connectMs"`
+	TLSMs     float64 `json:"tlsMs"`
+	TTFBMs    float64 `json:"ttfbMs"`
+	TotalMs   float64 `json:"totalMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// probeHandler performs a one-off uncached GetMap and reports its timings,
+// so operators can measure upstream responsiveness from the deployment.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if err := checkDuplicateParams(query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	area := areaParam(query)
+	wmsInfo, ok := radarLayers[area]
+	if !ok {
+		http.Error(w, "invalid area: "+area, http.StatusBadRequest)
+		return
+	}
+	var coords [3]int
+	for i, name := range []string{"z", "x", "y"} {
+		v, err := strconv.Atoi(query.Get(name))
+		if err != nil {
+			http.Error(w, "invalid "+name, http.StatusBadRequest)
+			return
+		}
+		coords[i] = v
+	}
+	if err := checkTileRange(coords[0], coords[2]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	coords[1] = tileGrids["EPSG:3857"].wrapX(coords[1], coords[0])
+
+	timestamp := query.Get("time")
+	if timestamp == "" {
+		if timestamps, err := getTimestamps(r.Context(), area); err == nil && len(timestamps) > 0 {
+			timestamp = timestamps[len(timestamps)-1]
+		}
+	}
+
+	mapURL := getMapURL(wmsInfo, formatBBox(wmsInfo, tileToBoundingBox(coords[1], coords[2], coords[0]), TILE_SIZE), TILE_SIZE, TILE_SIZE, timestamp, nil)
+	result := probeResult{URL: getMapURL(redactedLayer(wmsInfo), formatBBox(wmsInfo, tileToBoundingBox(coords[1], coords[2], coords[0]), TILE_SIZE), TILE_SIZE, TILE_SIZE, timestamp, nil)}
+
+	var dnsStart, connectStart, tlsStart time.Time
+	var ttfb time.Duration
+	start := time.Now()
+	trace := &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:           func(httptrace.DNSDoneInfo) { result.DNSMs = millis(time.Since(dnsStart)) },
+		ConnectStart:      func(string, string) { connectStart = time.Now() },
+		ConnectDone:       func(string, string, error) { result.ConnectMs = millis(time.Since(connectStart)) },
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { result.TLSMs = millis(time.Since(tlsStart)) },
+		GotFirstResponseByte: func() {
+			ttfb = time.Since(start)
+		},
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(r.Context(), trace), http.MethodGet, mapURL, nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// A one-off transport forces a fresh connection so the DNS, connect and
+	// TLS phases are measured rather than skipped by connection reuse.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	defer transport.CloseIdleConnections()
+	probeClient := &http.Client{Timeout: client.Timeout, Transport: transport, CheckRedirect: client.CheckRedirect}
+
+	resp, err := probeClient.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		n, err := io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		result.Status = resp.StatusCode
+		result.Bytes = int(n)
+		if err != nil {
+			result.Error = err.Error()
+		}
+	}
+	result.TTFBMs = millis(ttfb)
+	result.TotalMs = millis(time.Since(start))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// redactedLayer hides any credentials embedded in a layer's URL.
+func redactedLayer(wms WMSInfo) WMSInfo {
+	wms.URL = redactedURL(wms.URL)
+	return wms
+}
+
+// redactedURL hides any credentials embedded in a URL: the password and
+// the values of its query parameters, which often carry keys. The braces
+// of tile template placeholders are left unescaped so templates stay
+// readable. URLs that don't parse are hidden entirely.
+func redactedURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "[redacted]"
+	}
+	query := u.Query()
+	for name := range query {
+		query.Set(name, "xxxxx")
+	}
+	u.RawQuery = query.Encode()
+	return strings.NewReplacer("%7B", "{", "%7D", "}").Replace(u.Redacted())
+}
+
+// upstreamsHandler reports, per area, the upstream endpoint serving it and
+// its recent health.
+func upstreamsHandler(w http.ResponseWriter, r *http.Request) {
+	reports := make(map[string]upstreamReport, len(radarLayers)+1)
+	for area, wms := range radarLayers {
+		reports[area] = upstreamStatus(wms.URL, redactedLayer(wms).URL)
+	}
+	reports["hazards"] = upstreamStatus(hazardsLayer.URL, redactedLayer(hazardsLayer).URL)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reports)
+}
+
+// configHandler reports the effective runtime configuration, after defaults
+// and flags are applied, with secrets redacted.
+func configHandler(w http.ResponseWriter, r *http.Request) {
+	layers := make(map[string]WMSInfo, len(radarLayers))
+	for area, wms := range radarLayers {
+		layers[area] = redactedLayer(wms)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"config":          redactedConfig(),
+		"layers":          layers,
+		"hazards":         redactedLayer(hazardsLayer),
+		"tileSize":        TILE_SIZE,
+		"cacheDuration":   config.CacheTTL.String(),
+		"upstreamTimeout": client.Timeout.String(),
+	})
+}
@@ -0,0 +1,175 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// --- Animated GIFs ---
+
+// DEFAULT_GIF_DELAY is the per-frame delay of /animate without ?delay=.
+// Delays are clamped to [MIN_GIF_DELAY, MAX_GIF_DELAY]; many GIF viewers
+// ignore anything shorter than MIN_GIF_DELAY.
+const (
+	DEFAULT_GIF_DELAY = 500 * time.Millisecond
+	MIN_GIF_DELAY     = 20 * time.Millisecond
+	MAX_GIF_DELAY     = 10 * time.Second
+)
+
+// animateHandler serves /animate/{z}/{x}/{y}.gif, every cached frame of a
+// tile as one looping GIF.
+func animateHandler(w http.ResponseWriter, r *http.Request) {
+	zoom, x, y, status, err := parseTileCoords(r, tileGrids["EPSG:3857"], ".gif")
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	query := r.URL.Query()
+	if err := checkDuplicateParams(query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	area := areaParam(query)
+	radarInfo, ok := radarLayers[area]
+	if !ok {
+		http.Error(w, "invalid area: "+area, http.StatusBadRequest)
+		return
+	}
+	delay := DEFAULT_GIF_DELAY
+	if d := query.Get("delay"); d != "" {
+		if delay, err = time.ParseDuration(d); err != nil || delay < 0 {
+			http.Error(w, fmt.Sprintf("invalid delay %q", d), http.StatusBadRequest)
+			return
+		}
+		delay = min(max(delay, MIN_GIF_DELAY), MAX_GIF_DELAY)
+	}
+
+	timestamps, err := getTimestamps(r.Context(), area)
+	if err != nil || len(timestamps) == 0 {
+		http.Error(w, "Could not get timestamps", http.StatusInternalServerError)
+		return
+	}
+	if err := checkFrameBudget(len(timestamps), TILE_SIZE, TILE_SIZE); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	alerts, err := alertsRequested(query, area)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := fmt.Sprintf("gif %s/%d/%d/%d %s alerts=%t %s", area, zoom, x, y, delay, alerts, framesKey(timestamps))
+	result, err := renderAnimation(r.Context(), key, area, func(ctx context.Context) (animationResult, error) {
+		frames, partial, err := fetchAnimationFrames(ctx, radarInfo, tileToBoundingBox(x, y, zoom), timestamps, alerts)
+		if err != nil {
+			return animationResult{}, err
+		}
+		anim := &gif.GIF{Image: palettize(frames)}
+		anim.Config = image.Config{ColorModel: anim.Image[0].Palette, Width: TILE_SIZE, Height: TILE_SIZE}
+		for range anim.Image {
+			anim.Delay = append(anim.Delay, int(delay/(10*time.Millisecond)))
+			// Each frame replaces the last, so old echoes don't show
+			// through the transparent areas.
+			anim.Disposal = append(anim.Disposal, gif.DisposalBackground)
+		}
+		var buf bytes.Buffer
+		err = gif.EncodeAll(&buf, anim)
+		return animationResult{Data: buf.Bytes(), Partial: partial}, err
+	})
+	if err != nil {
+		writeAnimationError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("X-Radar-Timestamp", timestamps[len(timestamps)-1])
+	w.Write(result.Data)
+}
+
+// fetchAnimationFrames fetches the tile at every timestamp, with the alerts
+// overlay composited on when requested. Like tiles, frames whose overlay
+// fails are served without it and reported as partial.
+func fetchAnimationFrames(ctx context.Context, radarInfo WMSInfo, bounds [4]float64, timestamps []string, alerts bool) ([]image.Image, bool, error) {
+	var overlays []image.Image
+	var overlaysErr error
+	var wg sync.WaitGroup
+	if alerts {
+		wg.Go(func() {
+			overlays, overlaysErr = fetchFrames(ctx, hazardsLayer, formatBBox(hazardsLayer, bounds, TILE_SIZE), timestamps)
+		})
+	}
+	frames, err := fetchFrames(ctx, radarInfo, formatBBox(radarInfo, bounds, TILE_SIZE), timestamps)
+	wg.Wait()
+	if err != nil {
+		return nil, false, err
+	}
+	if overlaysErr != nil {
+		logf(ctx, "Animating without alerts: %v", overlaysErr)
+		return frames, true, nil
+	}
+	for i := range overlays {
+		frames[i] = compositeOver(frames[i], overlays[i])
+	}
+	return frames, false, nil
+}
+
+// palettize converts frames to paletted images sharing one palette, with
+// index 0 transparent. Radar tiles use few colours, so they are taken as
+// they appear; past 256 the nearest existing colour is used.
+func palettize(frames []image.Image) []*image.Paletted {
+	palette := color.Palette{color.Transparent}
+	index := make(map[color.NRGBA]uint8)
+	out := make([]*image.Paletted, len(frames))
+	for i, frame := range frames {
+		b := frame.Bounds()
+		p := image.NewPaletted(image.Rect(0, 0, b.Dx(), b.Dy()), nil)
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				c := color.NRGBAModel.Convert(frame.At(x, y)).(color.NRGBA)
+				if c.A < 0x80 {
+					continue
+				}
+				c.A = 0xff
+				idx, ok := index[c]
+				if !ok {
+					if len(palette) < 256 {
+						idx = uint8(len(palette))
+						palette = append(palette, c)
+					} else {
+						idx = uint8(palette[1:].Index(c) + 1)
+					}
+					index[c] = idx
+				}
+				p.SetColorIndex(x-b.Min.X, y-b.Min.Y, idx)
+			}
+		}
+		out[i] = p
+	}
+	for _, p := range out {
+		p.Palette = palette
+	}
+	return out
+}
@@ -0,0 +1,271 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// --- Image Annotations ---
+
+// toRGBA returns a mutable RGBA copy of img.
+func toRGBA(img image.Image) *image.RGBA {
+	out := image.NewRGBA(img.Bounds())
+	draw.Draw(out, out.Bounds(), img, img.Bounds().Min, draw.Src)
+	return out
+}
+
+// drawText writes s with its baseline starting at (x, y).
+func drawText(dst draw.Image, x, y int, s string, c color.Color) {
+	d := &font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(c),
+		Face: basicfont.Face7x13,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(s)
+}
+
+// groundResolution returns the ground meters per pixel at the center of a
+// Web Mercator extent (minX, minY, maxX, maxY) rendered width pixels wide.
+// Mercator stretches distances by 1/cos(latitude), so the projected
+// resolution is scaled back down.
+func groundResolution(m [4]float64, width int) float64 {
+	_, lat := mercatorToLonLat(0, (m[1]+m[3])/2)
+	return (m[2] - m[0]) / float64(width) * math.Cos(lat*math.Pi/180)
+}
+
+// niceDistance rounds meters down to 1, 2 or 5 times a power of ten.
+func niceDistance(meters float64) float64 {
+	magnitude := math.Pow(10, math.Floor(math.Log10(meters)))
+	for _, step := range []float64{5, 2, 1} {
+		if step*magnitude <= meters {
+			return step * magnitude
+		}
+	}
+	return magnitude
+}
+
+func formatDistance(meters float64) string {
+	if meters >= 1000 {
+		return fmt.Sprintf("%g km", meters/1000)
+	}
+	return fmt.Sprintf("%g m", meters)
+}
+
+// drawScaleBar draws a scale bar with end and middle ticks and a distance
+// label in the bottom-left corner. The bar is sized to a round distance no
+// longer than a quarter of the image width.
+func drawScaleBar(img image.Image, metersPerPixel float64) image.Image {
+	out := toRGBA(img)
+	b := out.Bounds()
+	if metersPerPixel <= 0 || b.Dx() < 40 || b.Dy() < 30 {
+		return out
+	}
+
+	distance := niceDistance(metersPerPixel * float64(b.Dx()) / 4)
+	length := int(math.Round(distance / metersPerPixel))
+	label := formatDistance(distance)
+
+	const margin, pad = 6, 3
+	barY := b.Max.Y - margin - pad
+	x0 := b.Min.X + margin + pad
+	x1 := x0 + length
+	labelWidth := font.MeasureString(basicfont.Face7x13, label).Ceil()
+
+	// A translucent backing keeps the bar legible over radar echoes.
+	backing := image.Rect(x0-pad, barY-13-8-pad, max(x1, x0+labelWidth)+pad, barY+pad+1)
+	draw.Draw(out, backing, image.NewUniform(color.NRGBA{0xff, 0xff, 0xff, 0xc0}), image.Point{}, draw.Over)
+
+	black := image.NewUniform(color.Black)
+	draw.Draw(out, image.Rect(x0, barY-1, x1, barY+1), black, image.Point{}, draw.Src)
+	for _, tx := range []int{x0, x0 + length/2, x1 - 1} {
+		draw.Draw(out, image.Rect(tx, barY-5, tx+1, barY+1), black, image.Point{}, draw.Src)
+	}
+	drawText(out, x0, barY-8, label, color.Black)
+	return out
+}
+
+// freshnessColors maps data-freshness buckets to indicator colours.
+var freshnessColors = map[string]color.NRGBA{
+	"green":  {0x2e, 0xcc, 0x40, 0xff},
+	"yellow": {0xff, 0xdc, 0x00, 0xff},
+	"red":    {0xff, 0x41, 0x36, 0xff},
+}
+
+// freshnessBucket classifies how old a frame is at now: green under 5
+// minutes, yellow under 15 and red beyond. Unparseable timestamps give "".
+func freshnessBucket(timestamp string, now time.Time) string {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return ""
+	}
+	switch age := now.Sub(t); {
+	case age < 5*time.Minute:
+		return "green"
+	case age < 15*time.Minute:
+		return "yellow"
+	default:
+		return "red"
+	}
+}
+
+// freshnessChange returns when a frame at timestamp leaves the bucket it is
+// in at now. It is false for red frames, which stay red, and unparseable
+// timestamps.
+func freshnessChange(timestamp string, now time.Time) (time.Time, bool) {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return time.Time{}, false
+	}
+	for _, boundary := range []time.Duration{5 * time.Minute, 15 * time.Minute} {
+		if now.Sub(t) < boundary {
+			return t.Add(boundary), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// drawFreshnessDot draws an outlined dot in the bucket's colour in the
+// top-right corner.
+func drawFreshnessDot(img image.Image, bucket string) image.Image {
+	fill, ok := freshnessColors[bucket]
+	if !ok {
+		return img
+	}
+	out := toRGBA(img)
+	b := out.Bounds()
+	cx, cy := b.Max.X-10, b.Min.Y+10
+	for y := cy - 6; y <= cy+6; y++ {
+		for x := cx - 6; x <= cx+6; x++ {
+			switch d := (x-cx)*(x-cx) + (y-cy)*(y-cy); {
+			case d <= 25:
+				out.Set(x, y, fill)
+			case d <= 42:
+				out.Set(x, y, color.Black)
+			}
+		}
+	}
+	return out
+}
+
+// drawTimestampLabel writes the frame time in the area's local time zone in
+// the top-left corner.
+func drawTimestampLabel(img image.Image, timestamp string, loc *time.Location) image.Image {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return img
+	}
+	out := toRGBA(img)
+	label := t.In(loc).Format("2006-01-02 15:04 MST")
+	b := out.Bounds()
+	labelWidth := font.MeasureString(basicfont.Face7x13, label).Ceil()
+	backing := image.Rect(b.Min.X+3, b.Min.Y+3, b.Min.X+9+labelWidth, b.Min.Y+21)
+	draw.Draw(out, backing, image.NewUniform(color.NRGBA{0xff, 0xff, 0xff, 0xc0}), image.Point{}, draw.Over)
+	drawText(out, b.Min.X+6, b.Min.Y+16, label, color.Black)
+	return out
+}
+
+// Legend swatch widths in pixels, selectable with ?legendSize=.
+const (
+	DEFAULT_LEGEND_SWATCH = 12
+	MIN_LEGEND_SWATCH     = 8
+	MAX_LEGEND_SWATCH     = 24
+)
+
+// legendCorners are the ?legendPosition= values.
+var legendCorners = []string{"top-left", "top-right", "bottom-left", "bottom-right"}
+
+// legendOptions is a parsed ?legend= request. Swatch is zero when no legend
+// was asked for.
+type legendOptions struct {
+	Corner string
+	Swatch int
+}
+
+// parseLegend parses ?legend=, ?legendPosition= and ?legendSize=.
+func parseLegend(query url.Values) (legendOptions, error) {
+	if show, err := parseBoolParam(query, "legend", false); err != nil || !show {
+		return legendOptions{}, err
+	}
+	opts := legendOptions{Corner: "bottom-right", Swatch: DEFAULT_LEGEND_SWATCH}
+	if v := query.Get("legendPosition"); v != "" {
+		if !slices.Contains(legendCorners, v) {
+			return opts, fmt.Errorf("invalid legendPosition: %s", v)
+		}
+		opts.Corner = v
+	}
+	if v := query.Get("legendSize"); v != "" {
+		swatch, err := strconv.Atoi(v)
+		if err != nil || swatch < MIN_LEGEND_SWATCH || swatch > MAX_LEGEND_SWATCH {
+			return opts, fmt.Errorf("invalid legendSize: %s (must be %d-%d)", v, MIN_LEGEND_SWATCH, MAX_LEGEND_SWATCH)
+		}
+		opts.Swatch = swatch
+	}
+	return opts, nil
+}
+
+// drawLegend draws a reflectivity colour bar, labelled every 15 dBZ, in the
+// requested corner. Images too small to hold it are returned unchanged.
+func drawLegend(img image.Image, opts legendOptions) image.Image {
+	if opts.Swatch == 0 {
+		return img
+	}
+	const margin, pad, barHeight = 6, 3, 8
+	unitWidth := font.MeasureString(basicfont.Face7x13, " dBZ").Ceil()
+	barWidth := len(reflectivityColormap) * opts.Swatch
+	width, height := pad+barWidth+unitWidth+pad, pad+barHeight+13+pad
+	b := img.Bounds()
+	if b.Dx() < width+2*margin || b.Dy() < height+2*margin {
+		return img
+	}
+
+	panel := image.Rect(b.Min.X+margin, b.Min.Y+margin, b.Min.X+margin+width, b.Min.Y+margin+height)
+	if opts.Corner == "top-right" || opts.Corner == "bottom-right" {
+		panel = panel.Add(image.Pt(b.Dx()-width-2*margin, 0))
+	}
+	if opts.Corner == "bottom-left" || opts.Corner == "bottom-right" {
+		panel = panel.Add(image.Pt(0, b.Dy()-height-2*margin))
+	}
+
+	out := toRGBA(img)
+	draw.Draw(out, panel, image.NewUniform(color.NRGBA{0xff, 0xff, 0xff, 0xc0}), image.Point{}, draw.Over)
+	x0, y0 := panel.Min.X+pad, panel.Min.Y+pad
+	// An outline keeps the white top bucket visible against the backing.
+	draw.Draw(out, image.Rect(x0-1, y0-1, x0+barWidth+1, y0+barHeight+1), image.NewUniform(color.Gray{0x80}), image.Point{}, draw.Src)
+	for i, entry := range reflectivityColormap {
+		swatch := image.Rect(x0+i*opts.Swatch, y0, x0+(i+1)*opts.Swatch, y0+barHeight)
+		draw.Draw(out, swatch, image.NewUniform(entry.Color), image.Point{}, draw.Src)
+		if i%3 == 0 {
+			drawText(out, swatch.Min.X, y0+barHeight+11, strconv.Itoa(entry.DBZ), color.Black)
+		}
+	}
+	drawText(out, x0+barWidth, y0+barHeight+11, " dBZ", color.Black)
+	return out
+}
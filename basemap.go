@@ -0,0 +1,60 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// --- Basemap Compositing ---
+
+// fetchBasemapTile fetches the basemap tile at z/x/y from the configured
+// XYZ tile template.
+func fetchBasemapTile(ctx context.Context, x, y, zoom int) (image.Image, error) {
+	tileURL := strings.NewReplacer(
+		"{z}", strconv.Itoa(zoom),
+		"{x}", strconv.Itoa(x),
+		"{y}", strconv.Itoa(y),
+	).Replace(config.BasemapURL)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	// Public tile servers such as OpenStreetMap's require an identifying
+	// User-Agent.
+	req.Header.Set("User-Agent", "wmsproxy (+https://github.com/blockarchitech/wmsproxy)")
+	setRequestIDHeader(ctx, req)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("basemap server returned status %d", resp.StatusCode)
+	}
+
+	img, _, err := image.Decode(resp.Body)
+	return img, err
+}
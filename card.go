@@ -0,0 +1,204 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Dashboard Cards ---
+
+// CARD_PANEL_WIDTH is the width in pixels of a card's text panel, which
+// fits the frame time in the 7x13 label font.
+const CARD_PANEL_WIDTH = 160
+
+// cardBackground fills a card's text panel.
+var cardBackground = color.NRGBA{0x20, 0x24, 0x2a, 0xff}
+
+// countHazardTypes returns how many distinct hazard types the hazards layer
+// has features for in a degree extent, read from each feature's
+// config.HazardTypeProperty with a WFS GetFeature query.
+func countHazardTypes(ctx context.Context, b [4]float64) (n int, err error) {
+	defer func() {
+		if err != nil {
+			metrics.upstreamErrors.Add(1)
+		}
+		if ctx.Err() == nil {
+			recordUpstream(hazardsLayer.URL, err)
+			recordUpstreamRequest("hazards", "GetFeature", err)
+		}
+	}()
+	params := url.Values{
+		"service":      {"WFS"},
+		"version":      {"1.0.0"},
+		"request":      {"GetFeature"},
+		"typeName":     {hazardsLayer.LayerName},
+		"propertyName": {config.HazardTypeProperty},
+		"outputFormat": {"application/json"},
+		"bbox":         {fmt.Sprintf("%f,%f,%f,%f,EPSG:4326", b[0], b[1], b[2], b[3])},
+	}
+	resp, err := doWithRetry(ctx, "hazards", "GetFeature", nil, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, hazardsLayer.URL+"?"+params.Encode(), nil)
+		if err == nil {
+			setRequestIDHeader(ctx, req)
+			setForwardedHeaders(ctx, req)
+		}
+		return req, err
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("WFS server returned status %d", resp.StatusCode)
+	}
+	var collection struct {
+		Features []struct {
+			Properties map[string]any `json:"properties"`
+		} `json:"features"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&collection); err != nil {
+		return 0, fmt.Errorf("decoding hazard features: %w", err)
+	}
+	types := make(map[string]bool)
+	for _, f := range collection.Features {
+		if t, ok := f.Properties[config.HazardTypeProperty].(string); ok && t != "" {
+			types[t] = true
+		}
+	}
+	return len(types), nil
+}
+
+// drawCard lays out a card: the radar image on the left and a panel of
+// lines of text on the right.
+func drawCard(radar image.Image, width, height int, lines []string) *image.RGBA {
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(out, radar.Bounds().Sub(radar.Bounds().Min), radar, radar.Bounds().Min, draw.Src)
+	panel := image.Rect(width-CARD_PANEL_WIDTH, 0, width, height)
+	draw.Draw(out, panel, image.NewUniform(cardBackground), image.Point{}, draw.Src)
+	for i, line := range lines {
+		drawText(out, panel.Min.X+8, 20+i*18, line, color.White)
+	}
+	return out
+}
+
+// cardHandler serves /card, a radar snapshot beside a text panel with the
+// area, frame time and, with alerts, the number of hazard types in view,
+// for glanceable dashboard widgets.
+func cardHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if err := checkDuplicateParams(query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	area := areaParam(query)
+	radarInfo, ok := radarLayers[area]
+	if !ok {
+		http.Error(w, "invalid area: "+area, http.StatusBadRequest)
+		return
+	}
+	extent := radarInfo.Extent
+	if bbox := query.Get("bbox"); bbox != "" {
+		var err error
+		if extent, err = parseLonLatBBox(bbox); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else if extent == [4]float64{} {
+		http.Error(w, "area "+area+" has no extent; bbox is required", http.StatusBadRequest)
+		return
+	}
+	width, err := parseDimension(query.Get("width"), 2*TILE_SIZE)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	height, err := parseDimension(query.Get("height"), TILE_SIZE)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if width <= CARD_PANEL_WIDTH {
+		http.Error(w, fmt.Sprintf("width must be more than the %d pixel text panel", CARD_PANEL_WIDTH), http.StatusBadRequest)
+		return
+	}
+	format, err := parseFormat(query, mapFormats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	showAlerts, err := alertsRequested(query, area)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timestamp := query.Get("time")
+	if timestamp == "" {
+		timestamps, err := getTimestamps(r.Context(), area)
+		if err != nil || len(timestamps) == 0 {
+			http.Error(w, "Could not get latest timestamp", http.StatusInternalServerError)
+			return
+		}
+		timestamp = timestamps[len(timestamps)-1]
+	}
+
+	// The hazard count is a separate upstream query, run alongside the radar.
+	mapWidth := width - CARD_PANEL_WIDTH
+	m := fitBoundingBox(extent, mapWidth, height)
+	var hazards int
+	var hazardsErr error
+	var wg sync.WaitGroup
+	if showAlerts {
+		wg.Go(func() { hazards, hazardsErr = countHazardTypes(r.Context(), lonLatBounds(m)) })
+	}
+	img, _, err := fetchRadarMap(r.Context(), radarInfo, m, mapWidth, height, timestamp, nil, nil, showAlerts)
+	wg.Wait()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	lines := []string{strings.ToUpper(area)}
+	if t, err := time.Parse(time.RFC3339, timestamp); err == nil {
+		lines = append(lines, t.In(radarInfo.location()).Format("2006-01-02 15:04 MST"))
+	}
+	switch {
+	case !showAlerts:
+	case hazardsErr != nil:
+		logf(r.Context(), "Could not count hazards for card: %v", hazardsErr)
+		lines = append(lines, "Hazards unavailable")
+	case hazards == 1:
+		lines = append(lines, "1 hazard type")
+	default:
+		lines = append(lines, fmt.Sprintf("%d hazard types", hazards))
+	}
+
+	w.Header().Set("X-Radar-Timestamp", timestamp)
+	w.Header().Set("Content-Type", contentType(format))
+	encodeImage(w, drawCard(img, width, height, lines), format)
+}
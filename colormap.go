@@ -0,0 +1,205 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"maps"
+	"sync"
+	"sync/atomic"
+)
+
+// --- Reflectivity Colormap ---
+
+// colormapEntry maps the lower bound of a reflectivity bucket to the colour
+// the upstream layer paints it with.
+type colormapEntry struct {
+	DBZ   int
+	Color color.NRGBA
+}
+
+// reflectivityColormap is the standard NWS base reflectivity palette used by
+// the NOAA bref_qcd layers, in 5 dBZ steps.
+var reflectivityColormap = []colormapEntry{
+	{5, color.NRGBA{0x04, 0xe9, 0xe7, 0xff}},
+	{10, color.NRGBA{0x01, 0x9f, 0xf4, 0xff}},
+	{15, color.NRGBA{0x03, 0x00, 0xf4, 0xff}},
+	{20, color.NRGBA{0x02, 0xfd, 0x02, 0xff}},
+	{25, color.NRGBA{0x01, 0xc5, 0x01, 0xff}},
+	{30, color.NRGBA{0x00, 0x8e, 0x00, 0xff}},
+	{35, color.NRGBA{0xfd, 0xf8, 0x02, 0xff}},
+	{40, color.NRGBA{0xe5, 0xbc, 0x00, 0xff}},
+	{45, color.NRGBA{0xfd, 0x95, 0x00, 0xff}},
+	{50, color.NRGBA{0xfd, 0x00, 0x00, 0xff}},
+	{55, color.NRGBA{0xd4, 0x00, 0x00, 0xff}},
+	{60, color.NRGBA{0xbc, 0x00, 0x00, 0xff}},
+	{65, color.NRGBA{0xf8, 0x00, 0xfd, 0xff}},
+	{70, color.NRGBA{0x98, 0x54, 0xc6, 0xff}},
+	{75, color.NRGBA{0xfd, 0xfd, 0xfd, 0xff}},
+}
+
+// colormapCache memoizes nearest colormap entries by RGB across requests,
+// since radar images use few distinct colours. The map it points to is
+// never modified: colormapLookup.done replaces it with a copy holding the
+// colours a render added, under colormapCacheMutex, so renders read it
+// without locking. It stops growing at config.ColormapCacheSize entries.
+var (
+	colormapCache      atomic.Pointer[map[uint32]int]
+	colormapCacheMutex = &sync.Mutex{}
+)
+
+// colormapLookup maps the pixels of one render to colormap entries. It
+// reads colormapCache as it was when the render started and memoizes
+// colours missing from it locally until done.
+type colormapLookup struct {
+	shared map[uint32]int
+	added  map[uint32]int
+}
+
+func newColormapLookup() *colormapLookup {
+	l := &colormapLookup{added: make(map[uint32]int)}
+	if shared := colormapCache.Load(); shared != nil {
+		l.shared = *shared
+	}
+	return l
+}
+
+// index returns the index of the colormap entry nearest to c, or -1 for
+// pixels too transparent to carry an echo.
+func (l *colormapLookup) index(c color.Color) int {
+	n := color.NRGBAModel.Convert(c).(color.NRGBA)
+	if n.A < 0x80 {
+		return -1
+	}
+	key := uint32(n.R)<<16 | uint32(n.G)<<8 | uint32(n.B)
+	if i, ok := l.shared[key]; ok {
+		return i
+	}
+	if i, ok := l.added[key]; ok {
+		return i
+	}
+	i := nearestColormapIndex(n)
+	l.added[key] = i
+	return i
+}
+
+// done adds the colours the render found to colormapCache.
+func (l *colormapLookup) done() {
+	if len(l.added) == 0 {
+		return
+	}
+	colormapCacheMutex.Lock()
+	defer colormapCacheMutex.Unlock()
+	var merged map[uint32]int
+	if shared := colormapCache.Load(); shared != nil {
+		merged = maps.Clone(*shared)
+	} else {
+		merged = make(map[uint32]int)
+	}
+	size := len(merged)
+	for key, i := range l.added {
+		if len(merged) >= config.ColormapCacheSize {
+			break
+		}
+		merged[key] = i
+	}
+	if len(merged) > size {
+		colormapCache.Store(&merged)
+	}
+}
+
+// nearestColormapIndex returns the index of the colormap entry with the
+// closest RGB to n.
+func nearestColormapIndex(n color.NRGBA) int {
+	best, bestDist := -1, -1
+	for i, entry := range reflectivityColormap {
+		dr := int(n.R) - int(entry.Color.R)
+		dg := int(n.G) - int(entry.Color.G)
+		db := int(n.B) - int(entry.Color.B)
+		if dist := dr*dr + dg*dg + db*db; bestDist < 0 || dist < bestDist {
+			best, bestDist = i, dist
+		}
+	}
+	return best
+}
+
+// radarPalettes are the replacement palettes selectable with ?palette=. Each
+// entry recolours the buckets from its DBZ up to the next entry's.
+var radarPalettes = map[string][]colormapEntry{
+	// pebble uses only the 64 colours of Pebble displays, with neighbouring
+	// intensities merged so each step stays distinguishable.
+	"pebble": {
+		{5, color.NRGBA{0x00, 0xaa, 0xff, 0xff}},
+		{15, color.NRGBA{0x00, 0x55, 0xff, 0xff}},
+		{20, color.NRGBA{0x00, 0xff, 0x00, 0xff}},
+		{30, color.NRGBA{0x00, 0xaa, 0x00, 0xff}},
+		{35, color.NRGBA{0xff, 0xff, 0x00, 0xff}},
+		{40, color.NRGBA{0xff, 0xaa, 0x00, 0xff}},
+		{45, color.NRGBA{0xff, 0x55, 0x00, 0xff}},
+		{50, color.NRGBA{0xff, 0x00, 0x00, 0xff}},
+		{60, color.NRGBA{0xaa, 0x00, 0x00, 0xff}},
+		{65, color.NRGBA{0xff, 0x00, 0xff, 0xff}},
+		{70, color.NRGBA{0xaa, 0x55, 0xff, 0xff}},
+		{75, color.NRGBA{0xff, 0xff, 0xff, 0xff}},
+	},
+	// grayscale darkens with intensity, for monochrome displays.
+	"grayscale": {
+		{5, color.NRGBA{0xaa, 0xaa, 0xaa, 0xff}},
+		{25, color.NRGBA{0x55, 0x55, 0x55, 0xff}},
+		{45, color.NRGBA{0x00, 0x00, 0x00, 0xff}},
+	},
+}
+
+// paletteColor returns the colour palette gives a reflectivity bucket: that
+// of the last entry at or below dbz, or the first entry's below them all.
+func paletteColor(palette []colormapEntry, dbz int) color.NRGBA {
+	c := palette[0].Color
+	for _, entry := range palette {
+		if entry.DBZ > dbz {
+			break
+		}
+		c = entry.Color
+	}
+	return c
+}
+
+// recolor maps every echo in img to its nearest reflectivity bucket's colour
+// in palette, keeping each pixel's alpha. Transparent pixels stay as they
+// are.
+func recolor(img image.Image, palette []colormapEntry) *image.NRGBA {
+	b := img.Bounds()
+	out := image.NewNRGBA(b)
+	targets := make([]color.NRGBA, len(reflectivityColormap))
+	for i, entry := range reflectivityColormap {
+		targets[i] = paletteColor(palette, entry.DBZ)
+	}
+	colors := newColormapLookup()
+	defer colors.done()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := img.At(x, y)
+			n := color.NRGBAModel.Convert(c).(color.NRGBA)
+			if i := colors.index(c); i >= 0 {
+				t := targets[i]
+				n.R, n.G, n.B = t.R, t.G, t.B
+			}
+			out.SetNRGBA(x, y, n)
+		}
+	}
+	return out
+}
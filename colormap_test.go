@@ -0,0 +1,120 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"image/color"
+	"testing"
+)
+
+// radarPixels returns a tile's worth of pixels like a reflectivity layer's:
+// a third transparent, the rest bucket colours with antialiasing noise.
+func radarPixels() []color.Color {
+	pixels := make([]color.Color, 0, TILE_SIZE*TILE_SIZE)
+	for y := range TILE_SIZE {
+		for x := range TILE_SIZE {
+			if (x/32+y/32)%3 == 0 {
+				pixels = append(pixels, color.NRGBA{})
+				continue
+			}
+			c := reflectivityColormap[(x*7+y*3)/64%len(reflectivityColormap)].Color
+			c.R += uint8((x + y) % 5)
+			c.B += uint8(x % 3)
+			pixels = append(pixels, c)
+		}
+	}
+	return pixels
+}
+
+func TestColormapLookup(t *testing.T) {
+	useConfig(t)
+	config.ColormapCacheSize = 4
+	colormapCache.Store(nil)
+	t.Cleanup(func() { colormapCache.Store(nil) })
+
+	pixels := radarPixels()
+	colors := newColormapLookup()
+	for _, c := range pixels {
+		want := -1
+		if n := color.NRGBAModel.Convert(c).(color.NRGBA); n.A >= 0x80 {
+			want = nearestColormapIndex(n)
+		}
+		if got := colors.index(c); got != want {
+			t.Fatalf("index(%v) = %d, want %d", c, got, want)
+		}
+	}
+	if len(colors.added) == 0 {
+		t.Fatal("lookup memoized no colours")
+	}
+	colors.done()
+	shared := *colormapCache.Load()
+	if len(shared) != config.ColormapCacheSize {
+		t.Errorf("shared cache holds %d colours, want the cap of %d", len(shared), config.ColormapCacheSize)
+	}
+	// Later renders start from the shared cache and leave it alone once
+	// it is full.
+	colors = newColormapLookup()
+	for key, i := range shared {
+		if got := colors.index(color.NRGBA{uint8(key >> 16), uint8(key >> 8), uint8(key), 0xff}); got != i {
+			t.Errorf("cached colour %06x: index %d, want %d", key, got, i)
+		}
+	}
+	for _, c := range pixels {
+		colors.index(c)
+	}
+	colors.done()
+	if len(*colormapCache.Load()) != config.ColormapCacheSize {
+		t.Errorf("full shared cache grew to %d colours", len(*colormapCache.Load()))
+	}
+}
+
+// BenchmarkColormapScan finds the nearest colormap entry of every pixel of
+// a tile without memoizing, for comparison with BenchmarkColormapLookup.
+func BenchmarkColormapScan(b *testing.B) {
+	pixels := radarPixels()
+	for b.Loop() {
+		for _, c := range pixels {
+			if n := color.NRGBAModel.Convert(c).(color.NRGBA); n.A >= 0x80 {
+				nearestColormapIndex(n)
+			}
+		}
+	}
+}
+
+func BenchmarkColormapLookup(b *testing.B) {
+	pixels := radarPixels()
+	for b.Loop() {
+		colors := newColormapLookup()
+		for _, c := range pixels {
+			colors.index(c)
+		}
+		colors.done()
+	}
+}
+
+func BenchmarkColormapLookupParallel(b *testing.B) {
+	pixels := radarPixels()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			colors := newColormapLookup()
+			for _, c := range pixels {
+				colors.index(c)
+			}
+			colors.done()
+		}
+	})
+}
@@ -0,0 +1,329 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- Multi-Frame Composites ---
+
+// fetchFrames fetches the same tile at every timestamp concurrently. The
+// returned slice is in timestamp order.
+func fetchFrames(ctx context.Context, wms WMSInfo, bbox string, timestamps []string) ([]image.Image, error) {
+	frames := make([]image.Image, len(timestamps))
+	errs := make([]error, len(timestamps))
+	var wg sync.WaitGroup
+	for i, timestamp := range timestamps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			frames[i], errs[i] = fetchWmsTile(ctx, wms, bbox, timestamp, nil)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return frames, nil
+}
+
+// framesIdentical reports whether every frame has the same pixels, as
+// during calm weather, by comparing a hash of each frame's RGBA data.
+func framesIdentical(frames []image.Image) bool {
+	var first uint64
+	for i, frame := range frames {
+		h := fnv.New64a()
+		rgba := toRGBA(frame)
+		fmt.Fprint(h, rgba.Rect)
+		h.Write(rgba.Pix)
+		if i == 0 {
+			first = h.Sum64()
+		} else if h.Sum64() != first {
+			return false
+		}
+	}
+	return true
+}
+
+// maxReflectivity combines frames into one image holding, per pixel, the
+// strongest echo seen in any of them. Colours are mapped back to dBZ buckets
+// with the reflectivity colormap so the maximum is taken in intensity space
+// rather than on raw RGB values.
+func maxReflectivity(frames []image.Image) *image.NRGBA {
+	bounds := frames[0].Bounds()
+	out := image.NewNRGBA(bounds)
+	colors := newColormapLookup()
+	defer colors.done()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			best := -1
+			for _, frame := range frames {
+				best = max(best, colors.index(frame.At(x, y)))
+			}
+			if best >= 0 {
+				out.SetNRGBA(x, y, reflectivityColormap[best].Color)
+			}
+		}
+	}
+	return out
+}
+
+// fadeAlpha returns the opacity of a frame age steps older than the newest
+// of count frames, following the configured fade curve from 1 for the
+// newest frame down to FadeMinAlpha for the oldest.
+func fadeAlpha(age, count int) float64 {
+	if count < 2 {
+		return 1
+	}
+	t := float64(age) / float64(count-1)
+	minAlpha := config.FadeMinAlpha
+	if config.FadeCurve == "exponential" {
+		return math.Pow(minAlpha, t)
+	}
+	return 1 - t*(1-minAlpha)
+}
+
+// fadeComposite layers frames from oldest to newest, each older frame drawn
+// more transparently, so storm motion shows up as a fading trail.
+func fadeComposite(frames []image.Image) *image.NRGBA {
+	out := image.NewNRGBA(frames[0].Bounds())
+	for i, frame := range frames {
+		alpha := fadeAlpha(len(frames)-1-i, len(frames))
+		mask := image.NewUniform(color.Alpha{A: uint8(math.Round(alpha * 0xff))})
+		draw.DrawMask(out, out.Bounds(), frame, frame.Bounds().Min, mask, image.Point{}, draw.Over)
+	}
+	return out
+}
+
+// animationSlots bounds the multi-frame requests rendering at once. It is
+// sized from config.MaxAnimations at startup.
+var animationSlots chan struct{}
+
+// errTooManyAnimations turns away renders beyond config.MaxAnimations with
+// 503 rather than queueing them, so a flood cannot pile up fetches.
+var errTooManyAnimations = errors.New("too many concurrent animation requests")
+
+// animationResult is an encoded multi-frame response. Collapsed is the
+// frame count when identical frames were served as one.
+type animationResult struct {
+	Data      []byte
+	Collapsed int
+	// Partial is set when the alerts overlay could not be fetched.
+	Partial bool
+}
+
+// animationCache briefly keeps encoded multi-frame responses, keyed on
+// every parameter that shapes them, for at most config.AnimationCacheTTL
+// and never past the next timestamp refresh.
+var (
+	animationCache      = make(map[string]animationCacheEntry)
+	animationCacheMutex = &sync.Mutex{}
+)
+
+type animationCacheEntry struct {
+	Result animationResult
+	Expiry time.Time
+}
+
+var animationFlight sharedFlight
+
+// framesKey identifies a frame window in animation cache keys.
+func framesKey(timestamps []string) string {
+	return fmt.Sprintf("%s..%s/%d", timestamps[0], timestamps[len(timestamps)-1], len(timestamps))
+}
+
+// renderAnimation returns the cached response for key, or renders it with
+// render. Identical concurrent requests share one render, which holds one
+// of the animationSlots. Requests forwarding different client headers
+// never share.
+func renderAnimation(ctx context.Context, key, area string, render func(ctx context.Context) (animationResult, error)) (animationResult, error) {
+	key += " " + forwardedKey(ctx)
+	animationCacheMutex.Lock()
+	entry, found := animationCache[key]
+	animationCacheMutex.Unlock()
+	if found && time.Now().Before(entry.Expiry) {
+		return entry.Result, nil
+	}
+
+	v, err := animationFlight.do(ctx, key, func(ctx context.Context) (any, error) {
+		select {
+		case animationSlots <- struct{}{}:
+			defer func() { <-animationSlots }()
+		default:
+			return nil, errTooManyAnimations
+		}
+		result, err := render(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ttl := min(config.AnimationCacheTTL, time.Until(cacheExpiry(ctx, area)))
+		if result.Partial {
+			ttl = min(ttl, config.NegativeTTL)
+		}
+		if ttl > 0 {
+			animationCacheMutex.Lock()
+			animationCache[key] = animationCacheEntry{Result: result, Expiry: time.Now().Add(ttl)}
+			animationCacheMutex.Unlock()
+		}
+		return result, nil
+	})
+	if err != nil {
+		return animationResult{}, err
+	}
+	return v.(animationResult), nil
+}
+
+func writeAnimationError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errTooManyAnimations) {
+		setRetryAfter(w, time.Second)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// checkFrameBudget rejects multi-frame requests over the configured frame
+// count or total decoded pixel budget. Callers check it before fetching so
+// oversized requests cost no upstream calls.
+func checkFrameBudget(frames, width, height int) error {
+	if frames > config.MaxFrames {
+		return fmt.Errorf("too many frames: %d (maximum %d)", frames, config.MaxFrames)
+	}
+	if pixels := int64(frames) * int64(width) * int64(height); pixels > config.MaxFramePixels {
+		return fmt.Errorf("request too large: %d pixels across frames (maximum %d)", pixels, config.MaxFramePixels)
+	}
+	return nil
+}
+
+// maxCompositeHandler serves /composite/max/{z}/{x}/{y}.png, a "storm track"
+// tile accumulating the maximum reflectivity over the last frames.
+func maxCompositeHandler(w http.ResponseWriter, r *http.Request) {
+	zoom, x, y, status, err := parseTileCoords(r, tileGrids["EPSG:3857"], ".png")
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	query := r.URL.Query()
+	if err := checkDuplicateParams(query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format, err := parseFormat(query, compositeFormats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	legend, err := parseLegend(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	area := areaParam(query)
+	radarInfo, ok := radarLayers[area]
+	if !ok {
+		http.Error(w, "invalid area: "+area, http.StatusBadRequest)
+		return
+	}
+
+	timestamps, err := getTimestamps(r.Context(), area)
+	if err != nil || len(timestamps) == 0 {
+		http.Error(w, "Could not get timestamps", http.StatusInternalServerError)
+		return
+	}
+	if n := query.Get("frames"); n != "" {
+		count, err := strconv.Atoi(n)
+		if err != nil || count < 1 {
+			http.Error(w, "invalid frames", http.StatusBadRequest)
+			return
+		}
+		if count < len(timestamps) {
+			timestamps = timestamps[len(timestamps)-count:]
+		}
+	}
+	if err := checkFrameBudget(len(timestamps), TILE_SIZE, TILE_SIZE); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// With no motion there is nothing to composite; serve the frame itself
+	// unless the client opted out with ?collapse=false.
+	collapse, err := parseBoolParam(query, "collapse", config.CollapseIdentical)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fade, err := parseBoolParam(query, "fade", false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scaleBar, err := parseBoolParam(query, "scalebar", false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key := fmt.Sprintf("max %s/%d/%d/%d %s collapse=%t fade=%t scalebar=%t legend=%+v %s", area, zoom, x, y, format, collapse, fade, scaleBar, legend, framesKey(timestamps))
+	result, err := renderAnimation(r.Context(), key, area, func(ctx context.Context) (animationResult, error) {
+		frames, err := fetchFrames(ctx, radarInfo, formatBBox(radarInfo, tileToBoundingBox(x, y, zoom), TILE_SIZE), timestamps)
+		if err != nil {
+			return animationResult{}, err
+		}
+		var result animationResult
+		var img image.Image
+		switch {
+		case collapse && len(frames) > 1 && framesIdentical(frames):
+			img = frames[len(frames)-1]
+			result.Collapsed = len(frames)
+		case fade:
+			img = fadeComposite(frames)
+		default:
+			img = maxReflectivity(frames)
+		}
+		if scaleBar {
+			img = drawScaleBar(img, groundResolution(tileToBoundingBox(x, y, zoom), TILE_SIZE))
+		}
+		img = drawLegend(img, legend)
+		var buf bytes.Buffer
+		err = encodeImage(&buf, img, format)
+		result.Data = buf.Bytes()
+		return result, err
+	})
+	if err != nil {
+		writeAnimationError(w, err)
+		return
+	}
+	if result.Collapsed > 0 {
+		w.Header().Set("X-Frames-Collapsed", strconv.Itoa(result.Collapsed))
+	}
+	w.Header().Set("Content-Type", contentType(format))
+	w.Write(result.Data)
+}
@@ -0,0 +1,75 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// compositeStatus serves path from maxCompositeHandler for a test area whose
+// upstream always returns a blank PNG, and returns the status.
+func compositeStatus(t *testing.T, path string) int {
+	t.Helper()
+	srv, _ := emptyThenPNG(t, 0, false)
+	useLayer(t, "testarea", WMSInfo{URL: srv.URL, LayerName: "conus_bref_qcd"})
+	animationCacheMutex.Lock()
+	clear(animationCache)
+	animationCacheMutex.Unlock()
+	saved := animationSlots
+	animationSlots = make(chan struct{}, 1)
+	t.Cleanup(func() { animationSlots = saved })
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /composite/max/{z}/{x}/{file}", maxCompositeHandler)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	return rec.Code
+}
+
+func TestMaxCompositeFrameBudget(t *testing.T) {
+	useConfig(t)
+	config.MaxFrames = 2
+	timestamps := []string{"2025-01-01T00:00:00Z", "2025-01-01T00:10:00Z", "2025-01-01T00:20:00Z"}
+	useCachedTimestamps(t, "testarea", CacheEntry{Timestamps: timestamps, All: timestamps, Expiry: time.Now().Add(time.Hour)})
+	tests := []struct {
+		frames string
+		want   int
+	}{
+		// The whole cached set is over budget.
+		{"", http.StatusBadRequest},
+		{"3", http.StatusBadRequest},
+		{"2", http.StatusOK},
+		{"1", http.StatusOK},
+		{"0", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if got := compositeStatus(t, "/composite/max/5/8/12.png?area=testarea&frames="+tt.frames); got != tt.want {
+			t.Errorf("?frames=%s with %d frames cached: status %d, want %d", tt.frames, len(timestamps), got, tt.want)
+		}
+	}
+
+	// More frames than are cached are clamped to the cached set rather
+	// than rejected, so long as that set is within budget.
+	config.MaxFrames = 3
+	for _, frames := range []string{"3", "4", "1000"} {
+		if got := compositeStatus(t, "/composite/max/5/8/12.png?area=testarea&frames="+frames); got != http.StatusOK {
+			t.Errorf("?frames=%s with %d frames cached: status %d, want 200", frames, len(timestamps), got)
+		}
+	}
+}
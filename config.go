@@ -0,0 +1,410 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// --- Runtime Configuration ---
+
+// Config holds the settings that can be tuned without recompiling.
+type Config struct {
+	// Port is the TCP port the server listens on.
+	Port string `json:"port"`
+
+	// CacheTTL is how long an area's timestamps are cached, and the least
+	// time a tile stays cached. Frames is how many of the latest timestamps
+	// make up an area's animation.
+	CacheTTL time.Duration `json:"cacheTTL"`
+	Frames   int           `json:"frames"`
+
+	// StaleIfError is how long past expiry cached timestamps are still
+	// served while GetCapabilities fails. Such /frames responses are marked
+	// stale and cacheable for only StaleMaxAge.
+	StaleIfError time.Duration `json:"staleIfError"`
+	StaleMaxAge  time.Duration `json:"staleMaxAge"`
+
+	// CapabilitiesMinTTL is how long fetched timestamps are reused even by
+	// ?nocache= tile requests, so those can't stampede GetCapabilities.
+	CapabilitiesMinTTL time.Duration `json:"capabilitiesMinTTL"`
+
+	// TimeMaxSkew is how far a tile's requested ?time= may be from the
+	// nearest available frame it is snapped to.
+	TimeMaxSkew time.Duration `json:"timeMaxSkew"`
+
+	// TimeFallback retries a failed timestamped GetMap once without TIME,
+	// returning the server's default frame instead of an error.
+	TimeFallback bool `json:"timeFallback"`
+
+	// NextFrameHeader sends X-Next-Frame-In on tiles of the latest frame,
+	// estimating the seconds until the next one is expected.
+	NextFrameHeader bool `json:"nextFrameHeader"`
+
+	// AdminToken guards the /admin endpoints. They are disabled when empty.
+	AdminToken string `json:"adminToken" redact:"true"`
+
+	// TLS serving is enabled when both a certificate and key are given.
+	TLSCert       string `json:"tlsCert"`
+	TLSKey        string `json:"tlsKey"`
+	TLSMinVersion string `json:"tlsMinVersion"`
+	TLSCiphers    string `json:"tlsCiphers"`
+
+	// MaskDir holds GeoJSON clip masks, selected per request by file name.
+	MaskDir string `json:"maskDir"`
+
+	// Upstream redirect handling. RestrictRedirects only follows redirects
+	// to hosts of configured layers, preventing redirect-based SSRF.
+	MaxRedirects      int  `json:"maxRedirects"`
+	LogRedirects      bool `json:"logRedirects"`
+	RestrictRedirects bool `json:"restrictRedirects"`
+
+	// BasemapURL is an XYZ tile template with {z}, {x} and {y} placeholders
+	// used for ?basemap=osm. BasemapAttribution is returned alongside those
+	// tiles to honor the provider's usage terms.
+	BasemapURL         string `json:"basemapURL" redact:"url"`
+	BasemapAttribution string `json:"basemapAttribution"`
+
+	// PostThreshold is the GetMap URL length above which the request is
+	// sent as a POST instead. Zero always uses GET.
+	PostThreshold int `json:"postThreshold"`
+
+	// Refresh keeps the timestamps of recently requested areas warm in the
+	// background. Areas idle for longer than RefreshIdle are skipped.
+	Refresh     bool          `json:"refresh"`
+	RefreshIdle time.Duration `json:"refreshIdle"`
+
+	// GIFFirstFrame accepts animated GIFs from GetMap by using their first
+	// frame instead of treating them as an error.
+	GIFFirstFrame bool `json:"gifFirstFrame"`
+
+	// FadeCurve ("linear" or "exponential") and FadeMinAlpha shape how
+	// older frames fade out in ?fade=true composites.
+	FadeCurve    string  `json:"fadeCurve"`
+	FadeMinAlpha float64 `json:"fadeMinAlpha"`
+
+	// FramesCoalesce is how long an encoded /frames response is reused for
+	// the same area. Zero disables the micro-cache.
+	FramesCoalesce time.Duration `json:"framesCoalesce"`
+
+	// PNGFallback retries PNGs the standard decoder rejects with the lenient
+	// decoder, when built with the lenientpng tag.
+	PNGFallback bool `json:"pngFallback"`
+
+	// Pregenerate renders every tile of an area and zoom range to disk and
+	// exits instead of serving.
+	Pregenerate        bool   `json:"pregenerate"`
+	PregenerateArea    string `json:"pregenerateArea"`
+	PregenerateZooms   string `json:"pregenerateZooms"`
+	PregenerateBBox    string `json:"pregenerateBBox"`
+	PregenerateDir     string `json:"pregenerateDir"`
+	PregenerateWorkers int    `json:"pregenerateWorkers"`
+	// ExportMBTiles writes the same tiles into an MBTiles file, then exits.
+	ExportMBTiles string `json:"exportMBTiles"`
+
+	// WarmTiles lists area/z/x/y tiles rendered into the cache at startup.
+	WarmTiles string `json:"warmTiles"`
+
+	// ForwardHeaders lists client request headers passed on to the WMS
+	// servers, for backends needing client credentials.
+	ForwardHeaders string `json:"forwardHeaders"`
+
+	// HazardTypeProperty is the hazards layer feature property /card
+	// counts distinct values of.
+	HazardTypeProperty string `json:"hazardTypeProperty"`
+
+	// CORSOrigins lists the browser origins allowed to read the public
+	// endpoints' responses; "*" allows any and empty disables CORS.
+	CORSOrigins string `json:"corsOrigins"`
+
+	// APIKeys lists name:key client credentials. When set, the public
+	// endpoints require a key and requests are counted per client, limited
+	// to APIKeyQuota per UsageReset period when the quota is positive.
+	APIKeys     string        `json:"apiKeys" redact:"true"`
+	APIKeyQuota int64         `json:"apiKeyQuota"`
+	UsageReset  time.Duration `json:"usageReset"`
+
+	// RateLimits lists class=rate[:burst] pairs limiting each client IP to
+	// rate requests per second on an endpoint class.
+	RateLimits string `json:"rateLimits"`
+
+	// TrustedProxies lists the addresses or prefixes of reverse proxies
+	// whose X-Forwarded-For names the client to rate limit.
+	TrustedProxies string `json:"trustedProxies"`
+
+	// MaxUpstreamRequests caps the GetMap requests in flight at once across
+	// all clients. Zero is unbounded.
+	MaxUpstreamRequests int `json:"maxUpstreamRequests"`
+
+	// UpstreamAttempts is how many times a GetMap or GetCapabilities
+	// request is tried when it fails with a network error or 5xx. Retries
+	// back off exponentially from UpstreamRetryDelay.
+	UpstreamAttempts   int           `json:"upstreamAttempts"`
+	UpstreamRetryDelay time.Duration `json:"upstreamRetryDelay"`
+
+	// RetryJitter is the largest random delay added to Retry-After headers.
+	RetryJitter time.Duration `json:"retryJitter"`
+
+	// MaxFrames and MaxFramePixels bound multi-frame requests: the number of
+	// frames and their total decoded size.
+	MaxFrames      int   `json:"maxFrames"`
+	MaxFramePixels int64 `json:"maxFramePixels"`
+	// MaxAnimations is how many multi-frame requests may render at once.
+	// Identical ones share a render, whose result is reused for up to
+	// AnimationCacheTTL.
+	MaxAnimations     int           `json:"maxAnimations"`
+	AnimationCacheTTL time.Duration `json:"animationCacheTTL"`
+
+	// CollapseIdentical serves a single static frame instead of compositing
+	// when every requested frame is identical.
+	CollapseIdentical bool `json:"collapseIdentical"`
+
+	// BBoxPrecision is the number of decimals in upstream BBOX coordinates.
+	// Negative chooses it from the request's resolution.
+	BBoxPrecision int `json:"bboxPrecision"`
+
+	// DegradeInFlight is the in-flight request count above which tiles are
+	// rendered in degraded quality to shed CPU. Zero disables.
+	DegradeInFlight int `json:"degradeInFlight"`
+
+	// ColormapCacheSize caps how many distinct colours have their nearest
+	// colormap entry memoized across requests. Zero disables the cache.
+	ColormapCacheSize int `json:"colormapCacheSize"`
+
+	// MaxTiles caps the number of tiles held in the in-memory cache. Zero
+	// is unbounded.
+	MaxTiles int `json:"maxTiles"`
+
+	// NegativeTTL is how long a blank tile served after an upstream failure
+	// is cached. Zero disables negative caching.
+	NegativeTTL time.Duration `json:"negativeTTL"`
+
+	// ShutdownTimeout bounds each shutdown step: stopping the background
+	// workers and draining the HTTP server.
+	ShutdownTimeout time.Duration `json:"shutdownTimeout"`
+
+	// DefaultAlerts lists the areas whose images include the hazards
+	// overlay unless a request passes ?alerts=false.
+	DefaultAlerts string `json:"defaultAlerts"`
+
+	// LayerConfig is a JSON file of layers to add to or replace the
+	// built-in ones.
+	LayerConfig string `json:"layerConfig"`
+
+	// AllowEmptyConfig falls back to the built-in layers when none are
+	// configured instead of refusing to start.
+	AllowEmptyConfig bool `json:"allowEmptyConfig"`
+
+	// LogFormat is json or text, and LogLevel the minimum slog level
+	// logged.
+	LogFormat string `json:"logFormat"`
+	LogLevel  string `json:"logLevel"`
+
+	// Debug enables testing aids such as the tile delay parameter. Never
+	// enable it in production.
+	Debug bool `json:"debug"`
+}
+
+var config = Config{
+	Port: "8080",
+
+	CacheTTL: 5 * time.Minute,
+	Frames:   12,
+
+	StaleIfError: time.Hour,
+	StaleMaxAge:  10 * time.Second,
+
+	CapabilitiesMinTTL: 15 * time.Second,
+	TimeMaxSkew:        15 * time.Minute,
+	NextFrameHeader:    true,
+
+	TLSMinVersion: "1.2",
+	MaxRedirects:  10,
+	LogRedirects:  true,
+
+	BasemapURL:         "https://tile.openstreetmap.org/{z}/{x}/{y}.png",
+	BasemapAttribution: "© OpenStreetMap contributors",
+
+	PostThreshold: 4096,
+
+	RefreshIdle: 30 * time.Minute,
+
+	FadeCurve:    "linear",
+	FadeMinAlpha: 0.2,
+
+	FramesCoalesce: 250 * time.Millisecond,
+
+	PregenerateArea:    "conus",
+	PregenerateZooms:   "0-6",
+	PregenerateDir:     "tiles",
+	PregenerateWorkers: 4,
+
+	MaxFrames:      24,
+	MaxFramePixels: 24 * 256 * 256,
+	MaxAnimations:  4,
+
+	AnimationCacheTTL: time.Minute,
+
+	CollapseIdentical: true,
+
+	HazardTypeProperty: "prod_type",
+
+	CORSOrigins: "*",
+	UsageReset:  24 * time.Hour,
+
+	RetryJitter: 2 * time.Second,
+
+	UpstreamAttempts:   3,
+	UpstreamRetryDelay: 200 * time.Millisecond,
+
+	BBoxPrecision: -1,
+
+	MaxTiles:          10000,
+	ColormapCacheSize: 4096,
+
+	ShutdownTimeout: 10 * time.Second,
+
+	LogFormat: "json",
+	LogLevel:  "info",
+}
+
+// registerFlags binds the command-line flags to config.
+func registerFlags() {
+	flag.StringVar(&config.Port, "port", config.Port, "TCP port to listen on (env WMSPROXY_PORT)")
+	flag.DurationVar(&config.CacheTTL, "cache-ttl", config.CacheTTL, "how long an area's timestamps are cached, and the minimum tile cache lifetime (env WMSPROXY_CACHE_TTL)")
+	flag.IntVar(&config.Frames, "frames", config.Frames, "number of most recent timestamps served per area (env WMSPROXY_FRAMES)")
+	flag.DurationVar(&config.StaleIfError, "stale-if-error", config.StaleIfError, "keep serving expired timestamps this long while GetCapabilities fails (0 disables)")
+	flag.DurationVar(&config.StaleMaxAge, "stale-max-age", config.StaleMaxAge, "Cache-Control max-age of frame lists served from stale timestamps")
+	flag.DurationVar(&config.CapabilitiesMinTTL, "capabilities-min-ttl", config.CapabilitiesMinTTL, "reuse fetched timestamps this long even for ?nocache= tile requests")
+	flag.DurationVar(&config.TimeMaxSkew, "time-max-skew", config.TimeMaxSkew, "snap a tile's ?time= to the nearest frame at most this far away")
+	flag.BoolVar(&config.TimeFallback, "time-fallback", config.TimeFallback, "retry a failed GetMap once without TIME, serving the server's default frame")
+	flag.BoolVar(&config.NextFrameHeader, "next-frame-header", config.NextFrameHeader, "send X-Next-Frame-In on latest-frame tiles with the seconds until the next frame")
+	flag.StringVar(&config.AdminToken, "admin-token", config.AdminToken, "bearer token required by the /admin endpoints (disabled when empty)")
+	flag.StringVar(&config.TLSCert, "tls-cert", config.TLSCert, "TLS certificate file; serves HTTPS together with -tls-key")
+	flag.StringVar(&config.TLSKey, "tls-key", config.TLSKey, "TLS private key file")
+	flag.StringVar(&config.TLSMinVersion, "tls-min-version", config.TLSMinVersion, "minimum TLS version to accept (1.0, 1.1, 1.2 or 1.3)")
+	flag.StringVar(&config.TLSCiphers, "tls-ciphers", config.TLSCiphers, "comma-separated TLS 1.0-1.2 cipher suites to allow (default: Go's secure set)")
+	flag.StringVar(&config.MaskDir, "mask-dir", config.MaskDir, "directory of <name>.geojson polygons usable as ?mask=<name>")
+	flag.IntVar(&config.MaxRedirects, "max-redirects", config.MaxRedirects, "maximum upstream redirects to follow (0 disables redirects)")
+	flag.BoolVar(&config.LogRedirects, "log-redirects", config.LogRedirects, "log every followed upstream redirect")
+	flag.BoolVar(&config.RestrictRedirects, "restrict-redirects", config.RestrictRedirects, "only follow redirects to hosts of configured layers")
+	flag.StringVar(&config.BasemapURL, "basemap-url", config.BasemapURL, "XYZ tile URL template for ?basemap=osm")
+	flag.StringVar(&config.BasemapAttribution, "basemap-attribution", config.BasemapAttribution, "attribution sent in X-Attribution with basemap tiles")
+	flag.IntVar(&config.PostThreshold, "post-threshold", config.PostThreshold, "GetMap URL length above which requests are sent as POST (0 disables)")
+	flag.BoolVar(&config.Refresh, "refresh", config.Refresh, "refresh recently requested areas' timestamps in the background")
+	flag.DurationVar(&config.RefreshIdle, "refresh-idle", config.RefreshIdle, "stop refreshing an area after it has gone unrequested this long")
+	flag.BoolVar(&config.GIFFirstFrame, "gif-first-frame", config.GIFFirstFrame, "use the first frame of animated GIFs returned by GetMap instead of failing")
+	flag.StringVar(&config.FadeCurve, "fade-curve", config.FadeCurve, "opacity curve for faded composites: linear or exponential")
+	flag.Float64Var(&config.FadeMinAlpha, "fade-min-alpha", config.FadeMinAlpha, "opacity of the oldest frame in faded composites (0-1)")
+	flag.DurationVar(&config.FramesCoalesce, "frames-coalesce", config.FramesCoalesce, "reuse an encoded /frames response for this long (0 disables)")
+	flag.BoolVar(&config.PNGFallback, "png-fallback", config.PNGFallback, "retry undecodable PNGs with the lenient decoder (requires the lenientpng build tag)")
+	flag.BoolVar(&config.Pregenerate, "pregenerate", config.Pregenerate, "write all tiles for an area and zoom range to disk, then exit")
+	flag.StringVar(&config.PregenerateArea, "pregenerate-area", config.PregenerateArea, "area to pregenerate")
+	flag.StringVar(&config.PregenerateZooms, "pregenerate-zooms", config.PregenerateZooms, "zoom range to pregenerate, as min-max")
+	flag.StringVar(&config.PregenerateBBox, "pregenerate-bbox", config.PregenerateBBox, "west,south,east,north extent to pregenerate (default: the whole area)")
+	flag.StringVar(&config.PregenerateDir, "pregenerate-dir", config.PregenerateDir, "output directory for pregenerated tiles")
+	flag.IntVar(&config.PregenerateWorkers, "pregenerate-workers", config.PregenerateWorkers, "concurrent tile fetches while pregenerating")
+	flag.StringVar(&config.WarmTiles, "warm-tiles", config.WarmTiles, "comma-separated area/z/x/y tiles to render into the cache at startup, e.g. conus/4/3/5")
+	flag.StringVar(&config.ExportMBTiles, "export-mbtiles", config.ExportMBTiles, "write the -pregenerate-* tiles to this new MBTiles file, then exit")
+	flag.StringVar(&config.ForwardHeaders, "forward-headers", config.ForwardHeaders, "comma-separated client request headers passed on to the WMS servers, e.g. Authorization,X-Tenant-ID")
+	flag.StringVar(&config.HazardTypeProperty, "hazard-type-property", config.HazardTypeProperty, "hazards layer feature property whose distinct values /card counts")
+	flag.StringVar(&config.CORSOrigins, "cors-origins", config.CORSOrigins, "comma-separated origins allowed to read responses from browsers, or * for any (disabled when empty)")
+	flag.StringVar(&config.APIKeys, "api-keys", config.APIKeys, "comma-separated name:key client credentials required by the public endpoints (disabled when empty)")
+	flag.Int64Var(&config.APIKeyQuota, "api-key-quota", config.APIKeyQuota, "requests allowed per API key each usage period (0 is unlimited)")
+	flag.DurationVar(&config.UsageReset, "usage-reset", config.UsageReset, "length of the API key usage accounting period")
+	flag.StringVar(&config.RateLimits, "rate-limits", config.RateLimits, "comma-separated class=rate[:burst] per-IP request limits, e.g. tiles=50:100,composite=1 (classes: tiles, frames, map, composite)")
+	flag.StringVar(&config.TrustedProxies, "trusted-proxies", config.TrustedProxies, "comma-separated proxy addresses or CIDR prefixes whose X-Forwarded-For identifies rate-limited clients")
+	flag.IntVar(&config.MaxUpstreamRequests, "max-upstream-requests", config.MaxUpstreamRequests, "maximum GetMap requests in flight at once across all clients (0 is unbounded)")
+	flag.IntVar(&config.UpstreamAttempts, "upstream-attempts", config.UpstreamAttempts, "attempts per upstream request on network errors and 5xx responses (1 disables retries)")
+	flag.DurationVar(&config.UpstreamRetryDelay, "upstream-retry-delay", config.UpstreamRetryDelay, "delay before the first upstream retry, doubling for each further one")
+	flag.DurationVar(&config.RetryJitter, "retry-jitter", config.RetryJitter, "largest random delay added to Retry-After headers (0 disables)")
+	flag.IntVar(&config.MaxFrames, "max-frames", config.MaxFrames, "maximum frames in one multi-frame request")
+	flag.Int64Var(&config.MaxFramePixels, "max-frame-pixels", config.MaxFramePixels, "maximum total decoded pixels across the frames of one request")
+	flag.IntVar(&config.MaxAnimations, "max-animations", config.MaxAnimations, "multi-frame requests allowed to render concurrently")
+	flag.DurationVar(&config.AnimationCacheTTL, "animation-cache-ttl", config.AnimationCacheTTL, "reuse a rendered multi-frame response this long, capped at the next timestamp refresh (0 disables)")
+	flag.BoolVar(&config.CollapseIdentical, "collapse-identical", config.CollapseIdentical, "serve one static frame when all frames of a multi-frame request are identical")
+	flag.IntVar(&config.BBoxPrecision, "bbox-precision", config.BBoxPrecision, "decimals in upstream BBOX coordinates (-1 chooses from the resolution)")
+	flag.IntVar(&config.DegradeInFlight, "degrade-in-flight", config.DegradeInFlight, "in-flight requests above which tiles are rendered in degraded quality (0 disables)")
+	flag.IntVar(&config.ColormapCacheSize, "colormap-cache-size", config.ColormapCacheSize, "distinct colours whose nearest reflectivity bucket is memoized for palettes and composites (0 disables)")
+	flag.IntVar(&config.MaxTiles, "max-tiles", config.MaxTiles, "maximum tiles in the in-memory cache, evicting least recently used (0 is unbounded)")
+	flag.DurationVar(&config.NegativeTTL, "negative-ttl", config.NegativeTTL, "cache the blank tiles served when upstream fails for this long (0 disables)")
+	flag.StringVar(&config.LogFormat, "log-format", config.LogFormat, "log output format: json, or text for local development")
+	flag.StringVar(&config.LogLevel, "log-level", config.LogLevel, "minimum level logged: debug, info, warn or error")
+	flag.DurationVar(&config.ShutdownTimeout, "shutdown-timeout", config.ShutdownTimeout, "how long shutdown waits for background workers, then for in-flight requests")
+	flag.StringVar(&config.DefaultAlerts, "default-alerts", config.DefaultAlerts, "comma-separated areas that show the hazards overlay unless a request passes ?alerts=false")
+	flag.StringVar(&config.LayerConfig, "config", config.LayerConfig, "JSON file of radar and hazards layers merged over, or replacing, the built-in NOAA layers")
+	flag.BoolVar(&config.AllowEmptyConfig, "allow-empty-config", config.AllowEmptyConfig, "fall back to the built-in NOAA layers when no layers are configured instead of exiting")
+	flag.BoolVar(&config.Debug, "debug", config.Debug, "enable debug-only request parameters such as ?delay= (never in production)")
+}
+
+// envFlags maps flags to the environment variables used when they are not
+// given on the command line.
+var envFlags = map[string]string{
+	"port":      "WMSPROXY_PORT",
+	"cache-ttl": "WMSPROXY_CACHE_TTL",
+	"frames":    "WMSPROXY_FRAMES",
+}
+
+// applyEnv sets flags from their environment variables. It must run before
+// flag.Parse so the command line takes precedence.
+func applyEnv() error {
+	for name, env := range envFlags {
+		if v, ok := os.LookupEnv(env); ok {
+			if err := flag.Set(name, v); err != nil {
+				return fmt.Errorf("%s: %v", env, err)
+			}
+		}
+	}
+	return nil
+}
+
+// usage prints the flag listing for -help.
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+// redactedConfig returns config as a JSON-ready map for display. Fields
+// tagged redact:"true" are masked when set, those tagged redact:"url" have
+// their credentials masked with redactedURL, and durations are rendered in
+// their readable form rather than as nanoseconds.
+func redactedConfig() map[string]any {
+	out := make(map[string]any)
+	v := reflect.ValueOf(config)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		value := v.Field(i).Interface()
+		switch {
+		case field.Tag.Get("redact") == "true":
+			if !v.Field(i).IsZero() {
+				value = "[redacted]"
+			}
+		case field.Tag.Get("redact") == "url":
+			value = redactedURL(value.(string))
+		case field.Type == reflect.TypeFor[time.Duration]():
+			value = value.(time.Duration).String()
+		}
+		out[name] = value
+	}
+	return out
+}
@@ -0,0 +1,85 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// --- CORS ---
+
+// corsOrigins are the browser origins allowed to read public responses,
+// parsed from config.CORSOrigins. "*" allows any origin and an empty list
+// disables CORS.
+var corsOrigins []string
+
+// CORS_EXPOSED_HEADERS are the response headers browser clients may read
+// besides the safelisted ones.
+const CORS_EXPOSED_HEADERS = "X-Radar-Timestamp, X-Next-Frame-In, X-Cache, X-Quality, X-Zoom, X-Attribution, X-Data-Stale, X-Frames-Collapsed, X-Request-ID"
+
+// CORS_ALLOWED_HEADERS are the request headers preflights may ask for,
+// besides the forwardHeaders.
+const CORS_ALLOWED_HEADERS = "X-API-Key, X-Request-ID"
+
+func parseCORSOrigins(list string) []string {
+	var origins []string
+	for _, origin := range strings.Split(list, ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// setCORSHeaders lets browser clients on allowed origins read the response.
+func setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	switch {
+	case slices.Contains(corsOrigins, "*"):
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	case origin != "" && slices.Contains(corsOrigins, origin):
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	default:
+		return
+	}
+	w.Header().Set("Access-Control-Expose-Headers", CORS_EXPOSED_HEADERS)
+}
+
+// withCORS adds the CORS headers to every response of a public endpoint,
+// including its errors, so browsers can read those too.
+func withCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		setCORSHeaders(w, r)
+		next(w, r)
+	}
+}
+
+// preflightHandler answers CORS preflight OPTIONS requests. Preflights
+// carry no credentials, so they bypass API keys and rate limits.
+func preflightHandler(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w, r)
+	w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+	if w.Header().Get("Access-Control-Allow-Origin") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD")
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(append([]string{CORS_ALLOWED_HEADERS}, forwardHeaders...), ", "))
+		w.Header().Set("Access-Control-Max-Age", "86400")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,71 @@
+//go:build lenientpng
+
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/png"
+)
+
+// --- Lenient PNG Decoding ---
+
+func init() {
+	lenientPNGDecode = decodeLenientPNG
+}
+
+var (
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+	pngIEND      = []byte("\x00\x00\x00\x00IEND\xaeB`\x82")
+)
+
+// decodeLenientPNG repairs the encoder quirks the standard decoder refuses,
+// then hands the result back to it. Chunk checksums are recomputed, a chunk
+// running past the end of the data ends the stream there, and anything
+// after IEND is discarded. Only the chunk framing is rewritten: the pixel
+// data is still decoded, and validated, by image/png.
+func decodeLenientPNG(data []byte) (image.Image, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errors.New("not a PNG")
+	}
+	repaired := bytes.NewBuffer(append([]byte(nil), pngSignature...))
+	rest := data[len(pngSignature):]
+	for len(rest) >= 8 {
+		if uint64(binary.BigEndian.Uint32(rest[:4]))+12 > uint64(len(rest)) {
+			break
+		}
+		length := int(binary.BigEndian.Uint32(rest[:4]))
+		chunk := rest[4 : 8+length]
+		if string(chunk[:4]) == "IEND" {
+			break
+		}
+		var header [4]byte
+		binary.BigEndian.PutUint32(header[:], uint32(length))
+		repaired.Write(header[:])
+		repaired.Write(chunk)
+		binary.BigEndian.PutUint32(header[:], crc32.ChecksumIEEE(chunk))
+		repaired.Write(header[:])
+		rest = rest[12+length:]
+	}
+	repaired.Write(pngIEND)
+	return png.Decode(repaired)
+}
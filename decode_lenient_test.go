@@ -0,0 +1,153 @@
+//go:build lenientpng
+
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+// lenientTestPNG returns an encoded 16x16 gradient and the image.
+func lenientTestPNG(t testing.TB) ([]byte, *image.NRGBA) {
+	img := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for y := range 16 {
+		for x := range 16 {
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 16), uint8(y * 16), 0x80, uint8(0xff - x)})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), img
+}
+
+// chunkEnd returns the offset just past the chunk of type name in data.
+func chunkEnd(t *testing.T, data []byte, name string) int {
+	i := bytes.Index(data, []byte(name))
+	if i < 4 {
+		t.Fatalf("no %s chunk", name)
+	}
+	return i + 8 + int(binary.BigEndian.Uint32(data[i-4:i]))
+}
+
+func TestDecodeLenientPNG(t *testing.T) {
+	data, want := lenientTestPNG(t)
+	idatEnd := chunkEnd(t, data, "IDAT")
+	badCRC := bytes.Clone(data)
+	badCRC[idatEnd-1] ^= 0xff
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"valid", data},
+		{"bad IDAT checksum", badCRC},
+		{"data after IEND", append(bytes.Clone(data), "trailing garbage"...)},
+		{"missing IEND", data[:len(data)-12]},
+		{"truncated IEND", data[:len(data)-5]},
+		{"IEND with a bad checksum", append(bytes.Clone(data[:len(data)-4]), 0, 0, 0, 0)},
+	}
+	for _, tt := range tests {
+		img, err := decodeLenientPNG(tt.data)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if img.Bounds() != want.Bounds() {
+			t.Errorf("%s: bounds %v, want %v", tt.name, img.Bounds(), want.Bounds())
+			continue
+		}
+		for y := range 16 {
+			for x := range 16 {
+				if got := color.NRGBAModel.Convert(img.At(x, y)); got != want.At(x, y) {
+					t.Fatalf("%s: pixel %d,%d = %v, want %v", tt.name, x, y, got, want.At(x, y))
+				}
+			}
+		}
+	}
+	// The standard decoder refuses the bad checksum the fallback repairs.
+	if _, err := png.Decode(bytes.NewReader(badCRC)); err == nil {
+		t.Error("image/png accepted a bad IDAT checksum; the test no longer covers a repair")
+	}
+}
+
+func TestDecodeLenientPNGInvalid(t *testing.T) {
+	data, _ := lenientTestPNG(t)
+	idatEnd := chunkEnd(t, data, "IDAT")
+	corrupt := bytes.Clone(data)
+	corrupt[idatEnd-8] ^= 0xff
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"not a PNG", []byte("<ServiceExceptionReport/>")},
+		{"signature only", data[:8]},
+		{"truncated IHDR", data[:20]},
+		{"truncated IDAT", data[:idatEnd-10]},
+		{"corrupt image data", corrupt},
+		{"chunk length past the end", append(bytes.Clone(data[:8]), 0xff, 0xff, 0xff, 0xff, 'I', 'H', 'D', 'R')},
+	}
+	for _, tt := range tests {
+		if img, err := decodeLenientPNG(tt.data); err == nil {
+			t.Errorf("%s: decoded %v, want error", tt.name, img.Bounds())
+		}
+	}
+}
+
+func FuzzDecodeLenientPNG(f *testing.F) {
+	data, _ := lenientTestPNG(f)
+	f.Add(data)
+	f.Add(data[:len(data)-12])
+	f.Add(append(bytes.Clone(data), "trailing"...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// Leave out images whose header asks for more memory than a tile,
+		// which the standard decoder would allocate just the same.
+		if cfg, err := decodeLenientConfig(data); err != nil || cfg.Width*cfg.Height > 1<<20 {
+			return
+		}
+		img, err := decodeLenientPNG(data)
+		if err != nil {
+			return
+		}
+		if img.Bounds().Empty() {
+			t.Errorf("decoded an empty image %v", img.Bounds())
+		}
+		// Whatever the standard decoder accepts, the fallback does too.
+		if std, err := png.Decode(bytes.NewReader(data)); err == nil && std.Bounds() != img.Bounds() {
+			t.Errorf("bounds %v, image/png decoded %v", img.Bounds(), std.Bounds())
+		}
+	})
+}
+
+// decodeLenientConfig reads the image size from data's IHDR without
+// checking its checksum.
+func decodeLenientConfig(data []byte) (image.Config, error) {
+	if len(data) < 33 {
+		return image.Config{}, png.FormatError("short")
+	}
+	fixed := bytes.Clone(data[:33])
+	binary.BigEndian.PutUint32(fixed[29:], crc32.ChecksumIEEE(fixed[12:29]))
+	return png.DecodeConfig(bytes.NewReader(fixed))
+}
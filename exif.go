@@ -0,0 +1,192 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/url"
+	"slices"
+	"time"
+)
+
+// --- JPEG Metadata ---
+
+// parseMetadata reads ?metadata=, which embeds EXIF metadata and is only
+// supported for JPEG output.
+func parseMetadata(query url.Values, format string) (bool, error) {
+	metadata, err := parseBoolParam(query, "metadata", false)
+	if err != nil {
+		return false, err
+	}
+	if metadata && format != "jpeg" {
+		return false, fmt.Errorf("metadata=true requires format=jpeg")
+	}
+	return metadata, nil
+}
+
+// encodeJPEGWithMetadata writes img as a JPEG carrying the frame's
+// timestamp as DateTimeOriginal and the image's center as its GPS
+// position. The full extent, which EXIF has no tag for, goes in
+// ImageDescription. b is the image's west, south, east, north extent in
+// degrees.
+func encodeJPEGWithMetadata(w io.Writer, img image.Image, timestamp string, b [4]float64) error {
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, img, "jpeg"); err != nil {
+		return err
+	}
+	west, south, east, north := b[0], b[1], b[2], b[3]
+	desc := fmt.Sprintf("Radar frame %s; bbox %.6f,%.6f,%.6f,%.6f", timestamp, west, south, east, north)
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		t = time.Time{}
+	}
+	tiff := exifTIFF(desc, t, (west+east)/2, (south+north)/2)
+
+	// The APP1 segment goes right after the start-of-image marker.
+	jpg := buf.Bytes()
+	segment := append([]byte{0xFF, 0xE1, 0, 0}, "Exif\x00\x00"...)
+	segment = append(segment, tiff...)
+	if len(segment)-2 > math.MaxUint16 {
+		return fmt.Errorf("EXIF segment too large")
+	}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(segment)-2))
+	_, err = w.Write(slices.Concat(jpg[:2], segment, jpg[2:]))
+	return err
+}
+
+// TIFF field types used in EXIF.
+const (
+	TIFF_BYTE     = 1
+	TIFF_ASCII    = 2
+	TIFF_LONG     = 4
+	TIFF_RATIONAL = 5
+)
+
+// ifdEntry is one tag of a TIFF image file directory.
+type ifdEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+func asciiEntry(tag uint16, s string) ifdEntry {
+	return ifdEntry{tag, TIFF_ASCII, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func longEntry(tag uint16, v uint32) ifdEntry {
+	return ifdEntry{tag, TIFF_LONG, 1, binary.BigEndian.AppendUint32(nil, v)}
+}
+
+// degreesEntry encodes an absolute coordinate as degrees, minutes and
+// seconds rationals.
+func degreesEntry(tag uint16, deg float64) ifdEntry {
+	deg = math.Abs(deg)
+	d := math.Floor(deg)
+	minutes := math.Floor((deg - d) * 60)
+	sec := ((deg-d)*60 - minutes) * 60
+	var b []byte
+	for _, r := range [][2]uint32{{uint32(d), 1}, {uint32(minutes), 1}, {uint32(math.Round(sec * 1000)), 1000}} {
+		b = binary.BigEndian.AppendUint32(b, r[0])
+		b = binary.BigEndian.AppendUint32(b, r[1])
+	}
+	return ifdEntry{tag, TIFF_RATIONAL, 3, b}
+}
+
+// ifdSize is the encoded size of a directory and its out-of-line values.
+func ifdSize(entries []ifdEntry) uint32 {
+	size := uint32(2 + 12*len(entries) + 4)
+	for _, e := range entries {
+		if len(e.value) > 4 {
+			size += uint32(len(e.value)+1) &^ 1
+		}
+	}
+	return size
+}
+
+// appendIFD encodes a directory starting at offset from the TIFF header.
+// Values over four bytes follow the directory, word-aligned.
+func appendIFD(b []byte, entries []ifdEntry, offset uint32) []byte {
+	slices.SortFunc(entries, func(a, b ifdEntry) int { return int(a.tag) - int(b.tag) })
+	b = binary.BigEndian.AppendUint16(b, uint16(len(entries)))
+	data := offset + uint32(2+12*len(entries)+4)
+	var values []byte
+	for _, e := range entries {
+		b = binary.BigEndian.AppendUint16(b, e.tag)
+		b = binary.BigEndian.AppendUint16(b, e.typ)
+		b = binary.BigEndian.AppendUint32(b, e.count)
+		if len(e.value) <= 4 {
+			b = append(b, e.value...)
+			b = append(b, make([]byte, 4-len(e.value))...)
+			continue
+		}
+		b = binary.BigEndian.AppendUint32(b, data+uint32(len(values)))
+		values = append(values, e.value...)
+		if len(e.value)%2 == 1 {
+			values = append(values, 0)
+		}
+	}
+	b = binary.BigEndian.AppendUint32(b, 0) // no next IFD
+	return append(b, values...)
+}
+
+// exifTIFF builds the big-endian TIFF structure of an EXIF segment. A zero
+// t omits the capture time.
+func exifTIFF(description string, t time.Time, lon, lat float64) []byte {
+	ifd0 := []ifdEntry{
+		asciiEntry(0x010E, description), // ImageDescription
+		asciiEntry(0x0131, "wmsproxy"),  // Software
+		longEntry(0x8769, 0),            // ExifIFDPointer, set below
+		longEntry(0x8825, 0),            // GPSInfoIFDPointer, set below
+	}
+	var exif []ifdEntry
+	if !t.IsZero() {
+		exif = append(exif,
+			asciiEntry(0x9003, t.UTC().Format("2006:01:02 15:04:05")), // DateTimeOriginal
+			asciiEntry(0x9011, "+00:00"),                              // OffsetTimeOriginal
+		)
+	}
+	latRef, lonRef := "N", "E"
+	if lat < 0 {
+		latRef = "S"
+	}
+	if lon < 0 {
+		lonRef = "W"
+	}
+	gps := []ifdEntry{
+		{0x0000, TIFF_BYTE, 4, []byte{2, 3, 0, 0}}, // GPSVersionID
+		asciiEntry(0x0001, latRef),
+		degreesEntry(0x0002, lat),
+		asciiEntry(0x0003, lonRef),
+		degreesEntry(0x0004, lon),
+	}
+
+	exifOffset := 8 + ifdSize(ifd0)
+	gpsOffset := exifOffset + ifdSize(exif)
+	ifd0[2] = longEntry(0x8769, exifOffset)
+	ifd0[3] = longEntry(0x8825, gpsOffset)
+
+	b := []byte{'M', 'M', 0, 42, 0, 0, 0, 8}
+	b = appendIFD(b, ifd0, 8)
+	b = appendIFD(b, exif, exifOffset)
+	return appendIFD(b, gps, gpsOffset)
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// --- Shared Upstream Fetches ---
+
+// sharedFlight collapses concurrent calls for a key into one, like
+// singleflight, but ties the shared call to its callers' contexts: it keeps
+// running while any caller still waits and is cancelled once all have gone.
+type sharedFlight struct {
+	group singleflight.Group
+	mu    sync.Mutex
+	calls map[string]*sharedCall
+}
+
+// sharedCall is the context of one in-progress call and how many callers
+// are waiting on it.
+type sharedCall struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// do runs fn once for concurrent callers of key and returns its result, or
+// ctx's error as soon as ctx is done. fn's context carries the first
+// caller's values.
+func (f *sharedFlight) do(ctx context.Context, key string, fn func(ctx context.Context) (any, error)) (any, error) {
+	f.mu.Lock()
+	if f.calls == nil {
+		f.calls = make(map[string]*sharedCall)
+	}
+	call, ok := f.calls[key]
+	if !ok {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &sharedCall{ctx: callCtx, cancel: cancel}
+		f.calls[key] = call
+	}
+	call.waiters++
+	f.mu.Unlock()
+
+	ch := f.group.DoChan(key, func() (any, error) { return fn(call.ctx) })
+	select {
+	case res := <-ch:
+		f.leave(key, call)
+		return res.Val, res.Err
+	case <-ctx.Done():
+		f.leave(key, call)
+		return nil, ctx.Err()
+	}
+}
+
+// leave drops a waiter, cancelling the call when none remain. The key is
+// forgotten so a later caller doesn't join the cancelled run.
+func (f *sharedFlight) leave(key string, call *sharedCall) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if call.waiters--; call.waiters > 0 {
+		return
+	}
+	call.cancel()
+	delete(f.calls, key)
+	f.group.Forget(key)
+}
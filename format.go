@@ -0,0 +1,81 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// --- Output Formats ---
+
+// Allowed output formats per endpoint. The first entry is the default.
+var (
+	tileFormats      = []string{"png", "jpeg", "gif"}
+	mapFormats       = []string{"png", "jpeg"}
+	compositeFormats = []string{"png"}
+)
+
+// parseFormat validates the format parameter against an endpoint's allowed
+// set. Unknown formats are rejected rather than silently served as PNG.
+func parseFormat(query url.Values, allowed []string) (string, error) {
+	format := strings.ToLower(query.Get("format"))
+	switch format {
+	case "":
+		return allowed[0], nil
+	case "jpg":
+		format = "jpeg"
+	}
+	if !slices.Contains(allowed, format) {
+		return "", fmt.Errorf("unsupported format %q; supported formats: %s", query.Get("format"), strings.Join(allowed, ", "))
+	}
+	return format, nil
+}
+
+// fastPNG trades compression ratio for speed, for degraded rendering.
+var fastPNG = png.Encoder{CompressionLevel: png.BestSpeed}
+
+// contentType returns the MIME type of an output format.
+func contentType(format string) string {
+	return "image/" + format
+}
+
+// encodeImage writes img in the given output format. JPEG has no alpha
+// channel, so transparent areas are flattened onto white first. GIF is
+// palettized as animations are, keeping a transparent index.
+func encodeImage(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case "jpeg":
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		return jpeg.Encode(w, flat, &jpeg.Options{Quality: 85})
+	case "gif":
+		return gif.Encode(w, palettize([]image.Image{img})[0], nil)
+	default:
+		return png.Encode(w, img)
+	}
+}
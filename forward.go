@@ -0,0 +1,107 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// --- Upstream Header Forwarding ---
+
+// forwardHeaders are the client request headers passed on to the WMS
+// servers, parsed from config.ForwardHeaders.
+var forwardHeaders []string
+
+// unforwardableHeaders describe a single connection or are set by the
+// proxy itself, so they are never forwarded.
+var unforwardableHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Host", "Content-Length", "Content-Type",
+}
+
+func parseForwardHeaders(list string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if slices.Contains(unforwardableHeaders, name) {
+			return nil, fmt.Errorf("%s cannot be forwarded", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// withForwardedHeaders stores the request's forwardable headers in its
+// context for the upstream requests made on its behalf. Headers the client
+// marked hop-by-hop in Connection are left out. Responses vary on the
+// forwarded headers, since they may depend on them.
+func withForwardedHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(forwardHeaders) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", strings.Join(forwardHeaders, ", "))
+		var hopByHop []string
+		for _, value := range r.Header.Values("Connection") {
+			for _, name := range strings.Split(value, ",") {
+				hopByHop = append(hopByHop, http.CanonicalHeaderKey(strings.TrimSpace(name)))
+			}
+		}
+		forwarded := http.Header{}
+		for _, name := range forwardHeaders {
+			if values := r.Header.Values(name); len(values) > 0 && !slices.Contains(hopByHop, name) {
+				forwarded[name] = slices.Clone(values)
+			}
+		}
+		if len(forwarded) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), forwardedHeadersKey, forwarded))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// setForwardedHeaders sets ctx's forwarded client headers on a WMS request.
+func setForwardedHeaders(ctx context.Context, req *http.Request) {
+	forwarded, _ := ctx.Value(forwardedHeadersKey).(http.Header)
+	for name, values := range forwarded {
+		req.Header[name] = values
+	}
+}
+
+// forwardedKey identifies ctx's forwarded header values in cache keys, so
+// that what was fetched with one client's credentials is never served to
+// another. It is empty when nothing is forwarded.
+func forwardedKey(ctx context.Context) string {
+	forwarded, _ := ctx.Value(forwardedHeadersKey).(http.Header)
+	if len(forwarded) == 0 {
+		return ""
+	}
+	h := sha256.New()
+	for _, name := range forwardHeaders {
+		fmt.Fprintf(h, "%s:%q\n", name, forwarded[name])
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
@@ -0,0 +1,210 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// --- Upstream Health ---
+
+// HEALTH_WINDOW is how far back upstream errors count as recent.
+const HEALTH_WINDOW = 5 * time.Minute
+
+// upstreamHealth tracks the recent outcomes of requests to one endpoint.
+type upstreamHealth struct {
+	errors        []time.Time
+	lastError     string
+	lastErrorAt   time.Time
+	lastSuccessAt time.Time
+}
+
+var (
+	health      = make(map[string]*upstreamHealth)
+	healthMutex = &sync.Mutex{}
+)
+
+// recordUpstream records the outcome of a request to an upstream endpoint.
+func recordUpstream(endpoint string, err error) {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	h, ok := health[endpoint]
+	if !ok {
+		h = &upstreamHealth{}
+		health[endpoint] = h
+	}
+	now := time.Now()
+	if err == nil {
+		h.lastSuccessAt = now
+		return
+	}
+	h.errors = append(pruneErrors(h.errors, now), now)
+	h.lastError = err.Error()
+	h.lastErrorAt = now
+}
+
+// pruneErrors drops error times older than HEALTH_WINDOW.
+func pruneErrors(errors []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(errors) && now.Sub(errors[i]) > HEALTH_WINDOW {
+		i++
+	}
+	return errors[i:]
+}
+
+// upstreamReport is the health of an endpoint as shown to operators.
+// State is "healthy" or "failing" after the most recent request, or
+// "unknown" before the first.
+type upstreamReport struct {
+	Endpoint      string     `json:"endpoint"`
+	State         string     `json:"state"`
+	RecentErrors  int        `json:"recentErrors"`
+	LastError     string     `json:"lastError,omitempty"`
+	LastErrorAt   *time.Time `json:"lastErrorAt,omitempty"`
+	LastSuccessAt *time.Time `json:"lastSuccessAt,omitempty"`
+}
+
+// upstreamStatus reports the health of endpoint, displayed as shown.
+func upstreamStatus(endpoint, shown string) upstreamReport {
+	healthMutex.Lock()
+	defer healthMutex.Unlock()
+	report := upstreamReport{Endpoint: shown, State: "unknown"}
+	h, ok := health[endpoint]
+	if !ok {
+		return report
+	}
+	h.errors = pruneErrors(h.errors, time.Now())
+	report.RecentErrors = len(h.errors)
+	report.LastError = h.lastError
+	if !h.lastErrorAt.IsZero() {
+		report.LastErrorAt = &h.lastErrorAt
+	}
+	if !h.lastSuccessAt.IsZero() {
+		report.LastSuccessAt = &h.lastSuccessAt
+	}
+	if h.lastErrorAt.After(h.lastSuccessAt) {
+		report.State = "failing"
+	} else {
+		report.State = "healthy"
+	}
+	return report
+}
+
+// --- Liveness and Readiness ---
+
+// READY_TIMEOUT bounds the upstream check made by /readyz.
+const READY_TIMEOUT = 3 * time.Second
+
+// READY_PROBE_TTL is how long the result of /readyz's upstream check is
+// reused. The endpoint is unauthenticated, so callers must not be able to
+// make it reach upstream on every request.
+const READY_PROBE_TTL = 5 * time.Second
+
+// readyProbe is the last result of /readyz's upstream check. Concurrent
+// checks share one request through readyFlight.
+var (
+	readyProbe struct {
+		err error
+		at  time.Time
+	}
+	readyProbeMutex = &sync.Mutex{}
+	readyFlight     sharedFlight
+)
+
+// healthzHandler serves /healthz, a liveness probe. It never touches the
+// network, so an upstream outage can't get the process restarted.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// readyzHandler serves /readyz, a readiness probe. The proxy is ready while
+// any area's timestamps are freshly cached; otherwise a HEAD request for the
+// conus GetCapabilities document must get a response within READY_TIMEOUT.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := checkReady(r.Context()); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"status": "unavailable", "error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+}
+
+// checkReady reports why the proxy can't serve radar, or nil if it can.
+func checkReady(ctx context.Context) error {
+	now := time.Now()
+	cacheMutex.RLock()
+	for _, entry := range cache {
+		if now.Before(entry.Expiry) {
+			cacheMutex.RUnlock()
+			return nil
+		}
+	}
+	cacheMutex.RUnlock()
+
+	readyProbeMutex.Lock()
+	err, at := readyProbe.err, readyProbe.at
+	readyProbeMutex.Unlock()
+	if time.Since(at) < READY_PROBE_TTL {
+		return err
+	}
+	_, err = readyFlight.do(ctx, "ready", func(ctx context.Context) (any, error) {
+		err := probeUpstream(ctx)
+		// A probe abandoned by every caller says nothing about upstream.
+		if ctx.Err() == nil {
+			readyProbeMutex.Lock()
+			readyProbe.err, readyProbe.at = err, time.Now()
+			readyProbeMutex.Unlock()
+		}
+		return nil, err
+	})
+	return err
+}
+
+// probeUpstream checks that the conus GetCapabilities document, or that of
+// the first area without conus, responds within READY_TIMEOUT.
+func probeUpstream(ctx context.Context) error {
+	wms, ok := radarLayers["conus"]
+	if !ok {
+		wms = radarLayers[slices.Sorted(maps.Keys(radarLayers))[0]]
+	}
+	ctx, cancel := context.WithTimeout(ctx, READY_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, wms.URL+"?service=wms&version="+wms.version()+"&request=GetCapabilities", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("upstream unreachable: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("upstream returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// --- Lifecycle ---
+
+// workerGroup owns the background workers. They all run under one context,
+// which stop cancels before waiting for them to return.
+type workerGroup struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func newWorkerGroup() *workerGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &workerGroup{ctx: ctx, cancel: cancel}
+}
+
+var workers = newWorkerGroup()
+
+// start runs a named worker in its own goroutine. run must return soon after
+// its context is cancelled.
+func (g *workerGroup) start(name string, run func(ctx context.Context)) {
+	g.wg.Go(func() {
+		run(g.ctx)
+		log.Printf("Worker %s stopped", name)
+	})
+}
+
+// stop cancels the workers and waits up to timeout for them to return.
+func (g *workerGroup) stop(timeout time.Duration) error {
+	g.cancel()
+	done := make(chan struct{})
+	go func() {
+		g.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("workers still running after %v", timeout)
+	}
+}
+
+// sleepContext sleeps for d, returning false early if ctx is cancelled.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// shutdown stops the background workers, then the server, each given up
+// to -shutdown-timeout.
+func shutdown(server *http.Server) error {
+	log.Printf("Stopping background workers")
+	if err := workers.stop(config.ShutdownTimeout); err != nil {
+		log.Printf("Shutdown: %v", err)
+	}
+	log.Printf("Closing HTTP server")
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
@@ -0,0 +1,153 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// --- Structured Logging ---
+
+// setupLogging installs the slog handler chosen by -log-format and
+// -log-level as the default. The standard log package is routed through it
+// too, so plain log.Printf lines come out in the same format at info level.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+		return fmt.Errorf("invalid -log-level %q: must be debug, info, warn or error", config.LogLevel)
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch config.LogFormat {
+	case "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid -log-format %q: must be json or text", config.LogFormat)
+	}
+	slog.SetDefault(slog.New(requestIDHandler{handler}))
+	return nil
+}
+
+// requestIDHandler adds the request ID of the record's context, if any, to
+// every record logged with one.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// logf logs like log.Printf, with ctx's request ID attached when it has one.
+func logf(ctx context.Context, format string, args ...any) {
+	slog.InfoContext(ctx, fmt.Sprintf(format, args...))
+}
+
+// tileLog collects the fields of a tile request's log line as the request
+// is served.
+type tileLog struct {
+	Tile  tileRequest
+	Cache string
+	// upstream is the total time spent in GetMap requests, in nanoseconds.
+	upstream atomic.Int64
+}
+
+type tileLogKey struct{}
+
+// trackUpstreamTime starts timing an upstream request made for ctx, and
+// returns the func that accounts it to ctx's tile request, if it is one.
+func trackUpstreamTime(ctx context.Context) func() {
+	start := time.Now()
+	return func() {
+		if l, ok := ctx.Value(tileLogKey{}).(*tileLog); ok {
+			l.upstream.Add(int64(time.Since(start)))
+		}
+	}
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// logTileRequests logs one line per tile request with the tile, the frame
+// served, the cache result, the time spent upstream and the status.
+func logTileRequests(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		l := &tileLog{}
+		sw := &statusWriter{ResponseWriter: w}
+		r = r.WithContext(context.WithValue(r.Context(), tileLogKey{}, l))
+		next(sw, r)
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "tile request",
+			slog.String("area", l.Tile.Area),
+			slog.Int("z", l.Tile.Z), slog.Int("x", l.Tile.X), slog.Int("y", l.Tile.Y),
+			slog.String("timestamp", l.Tile.Time),
+			slog.String("cache", l.Cache),
+			slog.Float64("upstream_ms", float64(l.upstream.Load())/float64(time.Millisecond)),
+			slog.Float64("duration_ms", float64(time.Since(start))/float64(time.Millisecond)),
+			slog.Int("status", max(sw.status, http.StatusOK)),
+		)
+	}
+}
+
+// tileLogFor returns r's tile log, or a throwaway one outside
+// logTileRequests.
+func tileLogFor(r *http.Request) *tileLog {
+	if l, ok := r.Context().Value(tileLogKey{}).(*tileLog); ok {
+		return l
+	}
+	return &tileLog{}
+}
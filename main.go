@@ -17,60 +17,357 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"container/list"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
 	"image"
 	"image/draw"
-	_ "image/png"
-	"image/png"
+	"image/gif"
+	_ "image/jpeg"
 	"io"
 	"log"
+	"maps"
 	"math"
+	"math/rand/v2"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+	// Embedded so time zones resolve in minimal containers without tzdata.
+	_ "time/tzdata"
+	"unicode"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // --- Structs for Parsing GetCapabilities XML ---
+
+// WMSCapabilities deliberately uses namespace-free tags: encoding/xml then
+// matches elements by local name alone, so default (xmlns="...") and
+// prefixed (wms:Layer) namespaces parse identically. Keep new tags
+// namespace-free for the same reason.
 type WMSCapabilities struct {
 	Capability struct {
-		Layer struct {
-			Layer struct {
-				Dimension struct {
-					Text string `xml:",chardata"`
-				} `xml:"Dimension"`
-			} `xml:"Layer"`
-		} `xml:"Layer"`
+		Layer capabilitiesLayer `xml:"Layer"`
 	} `xml:"Capability"`
 }
 
+type capabilitiesLayer struct {
+	Name       string                  `xml:"Name"`
+	Dimensions []capabilitiesDimension `xml:"Dimension"`
+	// WMS 1.1.1 lists the time values in Extent instead.
+	Extents []capabilitiesDimension `xml:"Extent"`
+	Layers  []capabilitiesLayer     `xml:"Layer"`
+}
+
+type capabilitiesDimension struct {
+	Name string `xml:"name,attr"`
+	Text string `xml:",chardata"`
+}
+
+// timeValues returns the values of the layer's own time dimension, if any.
+func (l capabilitiesLayer) timeValues() string {
+	for _, d := range slices.Concat(l.Dimensions, l.Extents) {
+		if strings.EqualFold(d.Name, "time") && strings.TrimSpace(d.Text) != "" {
+			return d.Text
+		}
+	}
+	return ""
+}
+
+// timeDimension walks the layer tree for the time values of the layer
+// called name, which inherits them from its nearest ancestor that has them
+// as WMS specifies. If no such layer advertises a time dimension, the first
+// one found anywhere in the tree is used.
+func (l capabilitiesLayer) timeDimension(name string) string {
+	var first string
+	var walk func(l capabilitiesLayer, inherited string) (string, bool)
+	walk = func(l capabilitiesLayer, inherited string) (string, bool) {
+		if values := l.timeValues(); values != "" {
+			inherited = values
+			if first == "" {
+				first = values
+			}
+		}
+		if l.Name == name && inherited != "" {
+			return inherited, true
+		}
+		for _, child := range l.Layers {
+			if values, ok := walk(child, inherited); ok {
+				return values, true
+			}
+		}
+		return "", false
+	}
+	if values, ok := walk(l, ""); ok {
+		return values
+	}
+	return first
+}
+
 // --- WMS and Caching Configuration ---
 type WMSInfo struct {
 	URL       string
 	LayerName string
+	// CRS is the projection GetMap requests use. Empty means EPSG:3857.
+	CRS string
+	// Version is the WMS version spoken to the server, 1.3.0 or 1.1.1.
+	// Empty means 1.3.0.
+	Version string
+	// Format is the GetMap image MIME type. Empty means image/png. PNG,
+	// JPEG and GIF responses can all be decoded and composited.
+	Format string
+	// TimeFormat is a Go time layout TIME values are re-emitted in for
+	// servers stricter than NOAA about ISO 8601 (e.g. no milliseconds).
+	// Empty passes timestamps through unchanged.
+	TimeFormat string
+	// TimeZone is the IANA zone local-time features such as timestamp
+	// labels use for the area. Empty means UTC.
+	TimeZone string
+	// Elevations are the radar tilts the layer accepts for the ELEVATION
+	// dimension. Requests for other values are rejected up front instead
+	// of producing an empty tile.
+	Elevations []string
+	// Extent is the area's coverage as west, south, east, north degrees,
+	// used when pregenerating the whole area.
+	Extent [4]float64
+	// DefaultAlerts draws the hazards overlay on the area's images when
+	// the client doesn't say otherwise with ?alerts=.
+	DefaultAlerts bool
+	// NoContentIsEmpty treats a 204 No Content GetMap response as a valid
+	// frame without data, rendered and cached as a transparent image,
+	// instead of an upstream failure.
+	NoContentIsEmpty bool
+}
+
+// defaultRadarLayers are the built-in NOAA layers.
+var defaultRadarLayers = map[string]WMSInfo{
+	"conus": {
+		URL:       "https://opengeo.ncep.noaa.gov/geoserver/conus/conus_bref_qcd/ows",
+		LayerName: "conus_bref_qcd",
+		Extent:    [4]float64{-127, 20, -66, 51},
+	},
+	"alaska": {
+		URL:       "https://opengeo.ncep.noaa.gov/geoserver/alaska/alaska_bref_qcd/ows",
+		LayerName: "alaska_bref_qcd",
+		TimeZone:  "America/Anchorage",
+		Extent:    [4]float64{-170, 50, -129, 72},
+	},
+	"hawaii": {
+		URL:       "https://opengeo.ncep.noaa.gov/geoserver/hawaii/hawaii_bref_qcd/ows",
+		LayerName: "hawaii_bref_qcd",
+		TimeZone:  "Pacific/Honolulu",
+		Extent:    [4]float64{-162, 17, -152, 24},
+	},
+	"carib": {
+		URL:       "https://opengeo.ncep.noaa.gov/geoserver/carib/carib_bref_qcd/ows",
+		LayerName: "carib_bref_qcd",
+		TimeZone:  "America/Puerto_Rico",
+		Extent:    [4]float64{-70, 15, -62, 21},
+	},
+	"guam": {
+		URL:       "https://opengeo.ncep.noaa.gov/geoserver/guam/guam_bref_qcd/ows",
+		LayerName: "guam_bref_qcd",
+		TimeZone:  "Pacific/Guam",
+		Extent:    [4]float64{140, 9, 150, 18},
+	},
+}
+
+// radarLayers are the layers served, keyed by area.
+var radarLayers = maps.Clone(defaultRadarLayers)
+
+var hazardsLayer = WMSInfo{URL: "https://opengeo.ncep.noaa.gov/geoserver/wwa/hazards/ows", LayerName: "hazards"}
+
+// crs returns the layer's projection, defaulting to Web Mercator.
+func (wms WMSInfo) crs() string {
+	if wms.CRS == "" {
+		return "EPSG:3857"
+	}
+	return wms.CRS
+}
+
+// version returns the layer's WMS version, defaulting to 1.3.0.
+func (wms WMSInfo) version() string {
+	if wms.Version == "" {
+		return "1.3.0"
+	}
+	return wms.Version
+}
+
+// format returns the layer's GetMap image format, defaulting to PNG.
+func (wms WMSInfo) format() string {
+	if wms.Format == "" {
+		return "image/png"
+	}
+	return wms.Format
+}
+
+// formatTime rewrites a timestamp into the layer's TimeFormat. Timestamps
+// that don't parse as RFC 3339 are passed through untouched.
+func (wms WMSInfo) formatTime(timestamp string) string {
+	if wms.TimeFormat == "" {
+		return timestamp
+	}
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return timestamp
+	}
+	return t.UTC().Format(wms.TimeFormat)
+}
+
+// location returns the area's time zone. TimeZone is checked by
+// validateLayers at startup, so lookups only fail for unvalidated layers,
+// which fall back to UTC.
+func (wms WMSInfo) location() *time.Location {
+	loc, err := time.LoadLocation(wms.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// layerConfig is the layer configuration file read by -config. Layers are
+// merged over the built-in ones, or replace them all with Replace. A
+// non-nil Hazards replaces the hazards layer.
+type layerConfig struct {
+	Replace bool               `json:"replace"`
+	Layers  map[string]WMSInfo `json:"layers"`
+	Hazards *WMSInfo           `json:"hazards"`
+}
+
+// loadLayerConfig applies the layer configuration file at path.
+func loadLayerConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var lc layerConfig
+	if err := decoder.Decode(&lc); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	if lc.Replace {
+		radarLayers = make(map[string]WMSInfo)
+	}
+	for area, wms := range lc.Layers {
+		radarLayers[area] = wms
+	}
+	if lc.Hazards != nil {
+		hazardsLayer = *lc.Hazards
+	}
+	return nil
+}
+
+// ensureLayers refuses to run without any layers, which would otherwise
+// fail every request with confusing errors. With -allow-empty-config it
+// falls back to the built-in NOAA layers instead.
+func ensureLayers() error {
+	if len(radarLayers) > 0 {
+		return nil
+	}
+	if !config.AllowEmptyConfig {
+		return fmt.Errorf("no layers configured")
+	}
+	log.Printf("No layers configured; falling back to the %d built-in NOAA layers (-allow-empty-config)", len(defaultRadarLayers))
+	radarLayers = maps.Clone(defaultRadarLayers)
+	return nil
 }
 
-var radarLayers = map[string]WMSInfo{
-	"conus":  {"https://opengeo.ncep.noaa.gov/geoserver/conus/conus_bref_qcd/ows", "conus_bref_qcd"},
-	"alaska": {"https://opengeo.ncep.noaa.gov/geoserver/alaska/alaska_bref_qcd/ows", "alaska_bref_qcd"},
-	"hawaii": {"https://opengeo.ncep.noaa.gov/geoserver/hawaii/hawaii_bref_qcd/ows", "hawaii_bref_qcd"},
-	"carib":  {"https://opengeo.ncep.noaa.gov/geoserver/carib/carib_bref_qcd/ows", "carib_bref_qcd"},
-	"guam":   {"https://opengeo.ncep.noaa.gov/geoserver/guam/guam_bref_qcd/ows", "guam_bref_qcd"},
+// applyDefaultAlerts turns on DefaultAlerts for a comma-separated list of
+// areas.
+func applyDefaultAlerts(list string) error {
+	for _, area := range strings.Split(list, ",") {
+		if area = strings.TrimSpace(area); area == "" {
+			continue
+		}
+		wms, ok := radarLayers[area]
+		if !ok {
+			return fmt.Errorf("invalid area: %s", area)
+		}
+		wms.DefaultAlerts = true
+		radarLayers[area] = wms
+	}
+	return nil
 }
 
-var hazardsLayer = WMSInfo{"https://opengeo.ncep.noaa.gov/geoserver/wwa/hazards/ows", "hazards"}
+// validateLayers checks that every configured layer can be requested.
+func validateLayers() error {
+	for area, wms := range radarLayers {
+		if area != strings.ToLower(area) {
+			return fmt.Errorf("layer %s: area names must be lowercase", area)
+		}
+		if wms.URL == "" || wms.LayerName == "" {
+			return fmt.Errorf("layer %s: URL and LayerName are required", area)
+		}
+		if !supportedCRS[wms.crs()] {
+			return fmt.Errorf("layer %s: unsupported CRS %s", area, wms.crs())
+		}
+		if !supportedVersions[wms.version()] {
+			return fmt.Errorf("layer %s: unsupported WMS version %s", area, wms.version())
+		}
+		if _, err := time.LoadLocation(wms.TimeZone); err != nil {
+			return fmt.Errorf("layer %s: invalid time zone %q: %w", area, wms.TimeZone, err)
+		}
+	}
+	if hazardsLayer.URL == "" || hazardsLayer.LayerName == "" {
+		return fmt.Errorf("hazards layer: URL and LayerName are required")
+	}
+	if !supportedCRS[hazardsLayer.crs()] {
+		return fmt.Errorf("hazards layer: unsupported CRS %s", hazardsLayer.crs())
+	}
+	if !supportedVersions[hazardsLayer.version()] {
+		return fmt.Errorf("hazards layer: unsupported WMS version %s", hazardsLayer.version())
+	}
+	return nil
+}
 
+// TILE_SIZE is the pixel size of the XYZ tile grid, which all extent and
+// resolution math is based on. High-DPI tiles cover the same extent with
+// more pixels; see tileRequest.pixelSize.
 const TILE_SIZE = 256
-const CACHE_DURATION = 5 * time.Minute
+
+// MAX_TILE_SCALE is the largest ?scale= for high-DPI tiles.
+const MAX_TILE_SCALE = 2
+
+// FRAME_WINDOW is roughly how long a frame stays among an area's recent
+// animation frames.
+const FRAME_WINDOW = time.Hour
+
+// BLANK_TILE_MAX_AGE is the minimum client cache lifetime of the blank
+// tiles served when upstream fails.
+const BLANK_TILE_MAX_AGE = 15 * time.Second
+
+// DEGRADED_TILE_MAX_AGE is the client cache lifetime of tiles rendered at
+// degraded quality under load.
+const DEGRADED_TILE_MAX_AGE = 15 * time.Second
+
+// MAX_DEBUG_DELAY caps the artificial ?delay= on tiles in debug mode.
+const MAX_DEBUG_DELAY = 30 * time.Second
 
 // --- Caching Mechanism ---
 type CacheEntry struct {
 	Timestamps []string
-	Expiry     time.Time
+	// All is every timestamp the server advertised, oldest first, kept so
+	// frame list deltas can be computed against older windows.
+	All     []string
+	Expiry  time.Time
+	Fetched time.Time
 }
 
 var (
@@ -78,32 +375,311 @@ var (
 	cacheMutex = &sync.RWMutex{}
 )
 
+// lastAccess tracks when each area was last requested so the background
+// refresher only keeps recently used areas warm.
+var (
+	lastAccess  = make(map[string]time.Time)
+	accessMutex = &sync.Mutex{}
+)
+
+// tileCacheEntry holds an encoded tile ready to be written to clients.
+// Negative entries are blank tiles stored after an upstream failure; they
+// carry their area and zoom so a later success nearby can purge them.
+// Partial entries are missing the alerts overlay they were asked for.
+type tileCacheEntry struct {
+	Key      string
+	Data     []byte
+	Expiry   time.Time
+	Negative bool
+	Partial  bool
+	Area     string
+	Zoom     int
+}
+
+// The tile cache is an LRU: tileLRU orders entries from most to least
+// recently used and tileCache indexes its elements by key. When it holds
+// more than config.MaxTiles entries the least recently used are evicted.
+var (
+	tileCache      = make(map[string]*list.Element)
+	tileLRU        = list.New()
+	tileCacheMutex = &sync.Mutex{}
+	// negativeKeys indexes negative tileCache entries by area and zoom.
+	negativeKeys = make(map[string][]string)
+)
+
+func getCachedTile(key string) (tileCacheEntry, bool) {
+	tileCacheMutex.Lock()
+	defer tileCacheMutex.Unlock()
+	el, found := tileCache[key]
+	if !found {
+		return tileCacheEntry{}, false
+	}
+	entry := el.Value.(*tileCacheEntry)
+	if time.Now().After(entry.Expiry) {
+		return tileCacheEntry{}, false
+	}
+	tileLRU.MoveToFront(el)
+	return *entry, true
+}
+
+// storeTile inserts or replaces a tile cache entry and evicts the least
+// recently used entries over the cap. The caller holds tileCacheMutex.
+func storeTile(entry tileCacheEntry) {
+	if el, found := tileCache[entry.Key]; found {
+		el.Value = &entry
+		tileLRU.MoveToFront(el)
+	} else {
+		tileCache[entry.Key] = tileLRU.PushFront(&entry)
+	}
+	for config.MaxTiles > 0 && tileLRU.Len() > config.MaxTiles {
+		removeTile(tileLRU.Back())
+	}
+}
+
+// removeTile drops a tile cache element. The caller holds tileCacheMutex.
+func removeTile(el *list.Element) {
+	tileLRU.Remove(el)
+	delete(tileCache, el.Value.(*tileCacheEntry).Key)
+}
+
+func putCachedTile(key string, data []byte, ttl time.Duration) {
+	tileCacheMutex.Lock()
+	storeTile(tileCacheEntry{Key: key, Data: data, Expiry: time.Now().Add(ttl)})
+	tileCacheMutex.Unlock()
+}
+
+// tileTTL returns how long a tile of the frame at timestamp stays cached. A
+// frame's image never changes, so it is kept until the frame has aged out of
+// the animation window, and at least -cache-ttl. With -time-fallback a
+// tile may hold the server's default frame instead, so it only gets the
+// minimum.
+func tileTTL(timestamp string) time.Duration {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil || config.TimeFallback {
+		return config.CacheTTL
+	}
+	return max(time.Until(t.Add(FRAME_WINDOW)), config.CacheTTL)
+}
+
+// putPartialTile caches a tile missing its alerts overlay for
+// config.NegativeTTL, so the overlay is retried soon.
+func putPartialTile(key string, data []byte) {
+	tileCacheMutex.Lock()
+	defer tileCacheMutex.Unlock()
+	storeTile(tileCacheEntry{Key: key, Data: data, Expiry: time.Now().Add(config.NegativeTTL), Partial: true})
+}
+
+// putNegativeTile caches a blank tile for key for config.NegativeTTL.
+func putNegativeTile(key string, tile tileRequest, data []byte) {
+	group := fmt.Sprintf("%s/%d", tile.Area, tile.Z)
+	tileCacheMutex.Lock()
+	defer tileCacheMutex.Unlock()
+	storeTile(tileCacheEntry{
+		Key:      key,
+		Data:     data,
+		Expiry:   time.Now().Add(config.NegativeTTL),
+		Negative: true,
+		Area:     tile.Area,
+		Zoom:     tile.Z,
+	})
+	negativeKeys[group] = append(negativeKeys[group], key)
+}
+
+// purgeNegativeTiles drops negative entries for an area and zoom. It is
+// called after a successful render there, which suggests upstream has
+// recovered and the blanks should not outlive the outage.
+func purgeNegativeTiles(area string, zoom int) {
+	group := fmt.Sprintf("%s/%d", area, zoom)
+	tileCacheMutex.Lock()
+	defer tileCacheMutex.Unlock()
+	pending := len(negativeKeys[group])
+	if pending == 0 {
+		return
+	}
+	for _, key := range negativeKeys[group] {
+		if el, found := tileCache[key]; found && el.Value.(*tileCacheEntry).Negative {
+			removeTile(el)
+		}
+	}
+	delete(negativeKeys, group)
+	log.Printf("Upstream recovered for %s; purged %d negative tiles", group, pending)
+}
+
+// runCacheSweeper drops expired entries from every cache each minute, so
+// entries nobody asks for again do not stay resident forever.
+func runCacheSweeper(ctx context.Context) {
+	for sleepContext(ctx, time.Minute) {
+		now := time.Now()
+
+		tileCacheMutex.Lock()
+		for el := tileLRU.Front(); el != nil; {
+			next := el.Next()
+			if now.After(el.Value.(*tileCacheEntry).Expiry) {
+				removeTile(el)
+			}
+			el = next
+		}
+		for group, keys := range negativeKeys {
+			keys = slices.DeleteFunc(keys, func(key string) bool { return tileCache[key] == nil })
+			if len(keys) == 0 {
+				delete(negativeKeys, group)
+			} else {
+				negativeKeys[group] = keys
+			}
+		}
+		tileCacheMutex.Unlock()
+
+		cacheMutex.Lock()
+		maps.DeleteFunc(cache, func(_ string, entry CacheEntry) bool {
+			return now.After(entry.Expiry.Add(config.StaleIfError))
+		})
+		cacheMutex.Unlock()
+
+		framesBodiesMutex.Lock()
+		maps.DeleteFunc(framesBodies, func(_ string, entry tileCacheEntry) bool { return now.After(entry.Expiry) })
+		framesBodiesMutex.Unlock()
+
+		animationCacheMutex.Lock()
+		maps.DeleteFunc(animationCache, func(_ string, entry animationCacheEntry) bool { return now.After(entry.Expiry) })
+		animationCacheMutex.Unlock()
+	}
+}
+
 var client = &http.Client{
-	Timeout: 15 * time.Second,
+	Timeout:       15 * time.Second,
+	CheckRedirect: checkRedirect,
+}
+
+// checkRedirect enforces the redirect policy for upstream requests. Followed
+// redirects are logged because they usually mean an endpoint has moved and
+// the layer configuration should be updated.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) > config.MaxRedirects {
+		return fmt.Errorf("stopped after %d redirects", config.MaxRedirects)
+	}
+	if config.RestrictRedirects && !upstreamHosts()[req.URL.Host] {
+		return fmt.Errorf("redirect to non-allowlisted host %s", req.URL.Host)
+	}
+	if config.LogRedirects {
+		log.Printf("Upstream redirect: %s -> %s", via[len(via)-1].URL.Redacted(), req.URL.Redacted())
+	}
+	return nil
+}
+
+// upstreamHosts returns the set of hosts the configured layers live on.
+func upstreamHosts() map[string]bool {
+	hosts := make(map[string]bool)
+	for _, wms := range append(slices.Collect(maps.Values(radarLayers)), hazardsLayer) {
+		if u, err := url.Parse(wms.URL); err == nil {
+			hosts[u.Host] = true
+		}
+	}
+	return hosts
 }
 
 // --- Core Logic ---
 
+// touchArea records that an area's frames were just requested.
+func touchArea(area string) {
+	accessMutex.Lock()
+	lastAccess[area] = time.Now()
+	accessMutex.Unlock()
+}
+
 // getTimestamps fetches and caches the available animation frames for a given area.
-func getTimestamps(area string) ([]string, error) {
+// When GetCapabilities fails, expired timestamps are still returned within
+// -stale-if-error of their expiry; timestampsStale tells the two apart.
+func getTimestamps(ctx context.Context, area string) ([]string, error) {
+	return loadTimestamps(ctx, area, false)
+}
+
+// getUncachedTimestamps is getTimestamps for ?nocache= requests: it refetches
+// unless the cached copy is younger than config.CapabilitiesMinTTL.
+func getUncachedTimestamps(ctx context.Context, area string) ([]string, error) {
+	return loadTimestamps(ctx, area, true)
+}
+
+func loadTimestamps(ctx context.Context, area string, nocache bool) ([]string, error) {
+	if _, ok := radarLayers[area]; !ok {
+		return nil, fmt.Errorf("invalid area: %s", area)
+	}
+	key := timestampsKey(ctx, area)
 	cacheMutex.RLock()
-	entry, found := cache[area]
+	entry, found := cache[key]
 	cacheMutex.RUnlock()
 
-	if found && time.Now().Before(entry.Expiry) {
+	fresh := found && time.Now().Before(entry.Expiry)
+	if nocache {
+		fresh = found && time.Since(entry.Fetched) < config.CapabilitiesMinTTL
+	}
+	if fresh {
 		log.Printf("Returning cached timestamps for '%s'", area)
+		metrics.cacheHits.Add(1)
+		promTimestampCache.WithLabelValues(area, "hit").Inc()
+		touchArea(area)
 		return entry.Timestamps, nil
 	}
+	metrics.cacheMisses.Add(1)
+	promTimestampCache.WithLabelValues(area, "miss").Inc()
+
+	// Concurrent misses for an area collapse into one GetCapabilities call,
+	// abandoned if every caller goes away.
+	v, err := timestampFlight.do(ctx, key, func(ctx context.Context) (any, error) {
+		log.Printf("Fetching new timestamps for '%s'", area)
+		return fetchTimestamps(ctx, area)
+	})
+	if err != nil {
+		// Upstream is failing: fall back to the expired copy for a while.
+		if ctx.Err() == nil && found && time.Since(entry.Expiry) < config.StaleIfError {
+			log.Printf("Serving stale timestamps for '%s': %v", area, err)
+			touchArea(area)
+			return entry.Timestamps, nil
+		}
+		return nil, err
+	}
+	touchArea(area)
+	return v.([]string), nil
+}
+
+var timestampFlight sharedFlight
+
+// timestampsKey is the cache key of an area's timestamps. Lists fetched with
+// forwarded client headers are kept apart per header values, as tiles are.
+func timestampsKey(ctx context.Context, area string) string {
+	if fk := forwardedKey(ctx); fk != "" {
+		return area + " " + fk
+	}
+	return area
+}
 
-	log.Printf("Fetching new timestamps for '%s'", area)
+// fetchTimestamps fetches an area's frames from GetCapabilities and stores
+// them in the cache, regardless of whether the cached copy is still fresh.
+func fetchTimestamps(ctx context.Context, area string) ([]string, error) {
 	wmsInfo, ok := radarLayers[area]
 	if !ok {
 		return nil, fmt.Errorf("invalid area: %s", area)
 	}
 
-	capsURL := fmt.Sprintf("%s?service=wms&version=1.3.0&request=GetCapabilities", wmsInfo.URL)
-	resp, err := client.Get(capsURL)
+	capsURL := fmt.Sprintf("%s?service=wms&version=%s&request=GetCapabilities", wmsInfo.URL, wmsInfo.version())
+	resp, err := doWithRetry(ctx, area, "GetCapabilities", nil, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, capsURL, nil)
+		if err == nil {
+			setRequestIDHeader(ctx, req)
+			setForwardedHeaders(ctx, req)
+		}
+		return req, err
+	})
+	if ctx.Err() != nil {
+		// Cancelled by the caller, which says nothing about upstream.
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, ctx.Err()
+	}
 	if err != nil {
+		metrics.upstreamErrors.Add(1)
+		recordUpstream(wmsInfo.URL, err)
+		recordUpstreamRequest(area, "GetCapabilities", err)
 		return nil, err
 	}
 	defer resp.Body.Close()
@@ -111,136 +687,1555 @@ func getTimestamps(area string) ([]string, error) {
 	body, _ := io.ReadAll(resp.Body)
 	var caps WMSCapabilities
 	if err := xml.Unmarshal(body, &caps); err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		metrics.upstreamErrors.Add(1)
+		recordUpstream(wmsInfo.URL, err)
+		recordUpstreamRequest(area, "GetCapabilities", err)
 		return nil, err
 	}
+	recordUpstream(wmsInfo.URL, nil)
+	recordUpstreamRequest(area, "GetCapabilities", nil)
 
-	timestamps := strings.Split(caps.Capability.Layer.Layer.Dimension.Text, ",")
-	frameCount := 12
+	// A request for several layers takes its frames from the first.
+	name, _, _ := strings.Cut(wmsInfo.LayerName, ",")
+	timestamps, err := expandTimeDimension(caps.Capability.Layer.timeDimension(name))
+	if err != nil {
+		return nil, fmt.Errorf("time dimension for '%s': %w", area, err)
+	}
+	frameCount := config.Frames
 	if len(timestamps) < frameCount {
 		frameCount = len(timestamps)
 	}
 	recentTimestamps := timestamps[len(timestamps)-frameCount:]
 
 	cacheMutex.Lock()
-	cache[area] = CacheEntry{
+	cache[timestampsKey(ctx, area)] = CacheEntry{
 		Timestamps: recentTimestamps,
-		Expiry:     time.Now().Add(CACHE_DURATION),
+		All:        timestamps,
+		Expiry:     time.Now().Add(config.CacheTTL),
+		Fetched:    time.Now(),
 	}
 	cacheMutex.Unlock()
 
 	return recentTimestamps, nil
 }
 
-func tileToBoundingBox(x, y, zoom int) (string) {
-	resolution := (2 * math.Pi * 6378137) / TILE_SIZE / math.Pow(2, float64(zoom))
-	minX := -20037508.3427892 + float64(x)*resolution*TILE_SIZE
-	maxY := 20037508.3427892 - float64(y)*resolution*TILE_SIZE
-	maxX := minX + resolution*TILE_SIZE
-	minY := maxY - resolution*TILE_SIZE
-	return fmt.Sprintf("%f,%f,%f,%f", minX, minY, maxX, maxY)
-}
+// MAX_INTERVAL_FRAMES caps how many timestamps a single interval may expand
+// to, so a misconfigured period can't allocate without bound. Longer
+// intervals keep their latest frames.
+const MAX_INTERVAL_FRAMES = 10000
 
-func fetchWmsTile(wms WMSInfo, bbox string, time string) (image.Image, error) {
-	params := url.Values{}
-	params.Add("SERVICE", "WMS")
-	params.Add("VERSION", "1.3.0")
-	params.Add("REQUEST", "GetMap")
-	params.Add("FORMAT", "image/png")
-	params.Add("TRANSPARENT", "true")
-	params.Add("LAYERS", wms.LayerName)
-	params.Add("WIDTH", strconv.Itoa(TILE_SIZE))
-	params.Add("HEIGHT", strconv.Itoa(TILE_SIZE))
-	params.Add("CRS", "EPSG:3857")
-	params.Add("BBOX", bbox)
-	if time != "" {
-		params.Add("TIME", time)
+// expandTimeDimension splits a WMS time Dimension into discrete timestamps.
+// Besides comma- or space-separated values, ISO 8601 intervals of the form
+// start/end/period are enumerated from start to end inclusive, or over their
+// last MAX_INTERVAL_FRAMES periods.
+func expandTimeDimension(text string) ([]string, error) {
+	var timestamps []string
+	separator := func(r rune) bool { return r == ',' || unicode.IsSpace(r) }
+	for _, value := range strings.FieldsFunc(text, separator) {
+		if !strings.Contains(value, "/") {
+			timestamps = append(timestamps, value)
+			continue
+		}
+
+		parts := strings.Split(value, "/")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid interval %q", value)
+		}
+		start, err := time.Parse(time.RFC3339, parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval start %q", parts[0])
+		}
+		end, err := time.Parse(time.RFC3339, parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid interval end %q", parts[1])
+		}
+		period, err := parseISODuration(parts[2])
+		if err != nil {
+			return nil, err
+		}
+		if end.Before(start) {
+			return nil, fmt.Errorf("interval %q ends before it starts", value)
+		}
+		last := int64(end.Sub(start) / period)
+		for i := max(0, last-MAX_INTERVAL_FRAMES+1); i <= last; i++ {
+			timestamps = append(timestamps, start.Add(time.Duration(i)*period).UTC().Format(time.RFC3339))
+		}
 	}
+	if len(timestamps) == 0 {
+		return nil, fmt.Errorf("no timestamps advertised")
+	}
+	return timestamps, nil
+}
 
-	wmsURL := fmt.Sprintf("%s?%s", wms.URL, params.Encode())
-	resp, err := client.Get(wmsURL)
-	if err != nil {
-		return nil, err
+// parseISODuration parses the fixed-length subset of ISO 8601 durations
+// (weeks, days, hours, minutes and seconds). Years and months are rejected
+// since their length depends on the calendar.
+func parseISODuration(s string) (time.Duration, error) {
+	rest, ok := strings.CutPrefix(s, "P")
+	if !ok || rest == "" {
+		return 0, fmt.Errorf("invalid period %q", s)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("WMS server returned status %d", resp.StatusCode)
+	var d time.Duration
+	inTime := false
+	for rest != "" {
+		if rest[0] == 'T' {
+			if inTime {
+				return 0, fmt.Errorf("invalid period %q", s)
+			}
+			inTime = true
+			rest = rest[1:]
+			continue
+		}
+		i := strings.IndexFunc(rest, func(r rune) bool {
+			return (r < '0' || r > '9') && r != '.'
+		})
+		if i <= 0 {
+			return 0, fmt.Errorf("invalid period %q", s)
+		}
+		n, err := strconv.ParseFloat(rest[:i], 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid period %q", s)
+		}
+
+		var unit time.Duration
+		switch {
+		case !inTime && rest[i] == 'W':
+			unit = 7 * 24 * time.Hour
+		case !inTime && rest[i] == 'D':
+			unit = 24 * time.Hour
+		case inTime && rest[i] == 'H':
+			unit = time.Hour
+		case inTime && rest[i] == 'M':
+			unit = time.Minute
+		case inTime && rest[i] == 'S':
+			unit = time.Second
+		default:
+			return 0, fmt.Errorf("unsupported period %q", s)
+		}
+		d += time.Duration(n * float64(unit))
+		rest = rest[i+1:]
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid period %q", s)
 	}
+	return d, nil
+}
 
-	img, _, err := image.Decode(resp.Body)
-	return img, err
+// cacheExpiry reports when the cached timestamps for an area go stale.
+func cacheExpiry(ctx context.Context, area string) time.Time {
+	cacheMutex.RLock()
+	defer cacheMutex.RUnlock()
+	return cache[timestampsKey(ctx, area)].Expiry
 }
 
-// --- HTTP Handlers ---
+// timestampsStale reports whether an area's cached timestamps have expired,
+// meaning getTimestamps fell back to them because upstream failed.
+func timestampsStale(ctx context.Context, area string) bool {
+	return time.Now().After(cacheExpiry(ctx, area))
+}
 
-func framesHandler(w http.ResponseWriter, r *http.Request) {
-	area := r.URL.Query().Get("area")
-	if area == "" {
-		area = "conus"
+// MIN_FRAME_GAPS is how many gaps between frames are needed before their
+// interval is trusted.
+const MIN_FRAME_GAPS = 3
+
+// frameInterval estimates the time between frames as the median gap between
+// consecutive timestamps. It is false when there are too few frames, or when
+// more than a quarter of the gaps are over 25% off the median.
+func frameInterval(timestamps []string) (time.Duration, bool) {
+	if len(timestamps) < MIN_FRAME_GAPS+1 {
+		return 0, false
+	}
+	gaps := make([]time.Duration, 0, len(timestamps)-1)
+	for i := 1; i < len(timestamps); i++ {
+		prev, err := time.Parse(time.RFC3339, timestamps[i-1])
+		if err != nil {
+			return 0, false
+		}
+		t, err := time.Parse(time.RFC3339, timestamps[i])
+		if err != nil {
+			return 0, false
+		}
+		gaps = append(gaps, t.Sub(prev))
+	}
+	slices.Sort(gaps)
+	median := gaps[len(gaps)/2]
+	if median <= 0 {
+		return 0, false
 	}
+	regular := 0
+	for _, gap := range gaps {
+		if (gap - median).Abs() <= median/4 {
+			regular++
+		}
+	}
+	return median, regular*4 >= len(gaps)*3
+}
 
-	timestamps, err := getTimestamps(area)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+// nextFrameIn estimates how long after now the frame following served, an
+// area's latest observed frame, is due: one frame interval after it. The
+// interval is taken from the frames up to served, leaving out any nowcast
+// frames after it. It is zero once the frame is due, and false when the
+// interval can't be estimated or the frame is over an interval late.
+func nextFrameIn(ctx context.Context, area, served string, now time.Time) (time.Duration, bool) {
+	cacheMutex.RLock()
+	timestamps := cache[timestampsKey(ctx, area)].Timestamps
+	cacheMutex.RUnlock()
+
+	i := slices.Index(timestamps, served)
+	if i < 0 {
+		return 0, false
+	}
+	interval, ok := frameInterval(timestamps[:i+1])
+	if !ok {
+		return 0, false
+	}
+	latest, _ := time.Parse(time.RFC3339, served)
+	wait := latest.Add(interval).Sub(now)
+	if wait < -interval {
+		return 0, false
+	}
+	return max(wait, 0), true
+}
+
+// setFramesCaching sets the caching headers of a frame list response. Fresh
+// lists may be reused for as long as our own copy is fresh; stale ones are
+// flagged and only briefly cacheable so clients refetch soon.
+func setFramesCaching(ctx context.Context, w http.ResponseWriter, area string) {
+	if timestampsStale(ctx, area) {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+		w.Header().Set("X-Data-Stale", "true")
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(config.StaleMaxAge.Seconds())))
 		return
 	}
+	maxAge := max(int(time.Until(cacheExpiry(ctx, area)).Seconds()), 0)
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge))
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(timestamps)
+// tileBounds returns the EPSG:3857 extent of an XYZ tile in meters.
+func tileBounds(x, y, zoom int) (minX, minY, maxX, maxY float64) {
+	resolution := (2 * math.Pi * 6378137) / TILE_SIZE / math.Pow(2, float64(zoom))
+	minX = -20037508.3427892 + float64(x)*resolution*TILE_SIZE
+	maxY = 20037508.3427892 - float64(y)*resolution*TILE_SIZE
+	maxX = minX + resolution*TILE_SIZE
+	minY = maxY - resolution*TILE_SIZE
+	return minX, minY, maxX, maxY
 }
 
-func tileHandler(w http.ResponseWriter, r *http.Request) {
-	parts := strings.Split(r.URL.Path, "/")
-	zoom, _ := strconv.Atoi(parts[2])
-	x, _ := strconv.Atoi(parts[3])
-	y, _ := strconv.Atoi(strings.TrimSuffix(parts[4], ".png"))
+// tileToBoundingBox returns the EPSG:3857 extent of an XYZ tile, to be
+// formatted for a layer with formatBBox. Columns are wrapped around the
+// antimeridian and the extent is clamped to the world. The EPSG:3857 entry
+// of tileGrids is built from this function, so its grid is spelled out.
+func tileToBoundingBox(x, y, zoom int) [4]float64 {
+	minX, minY, maxX, maxY := tileBounds(tileGrid{Columns: 1}.wrapX(x, zoom), y, zoom)
+	return clampMercator([4]float64{minX, minY, maxX, maxY})
+}
 
-	query := r.URL.Query()
-	area := query.Get("area")
-	if area == "" {
-		area = "conus"
+// fetchWmsTile requests a single TILE_SIZE square tile from the WMS server.
+// dims carries extra WMS dimension parameters such as ELEVATION.
+func fetchWmsTile(ctx context.Context, wms WMSInfo, bbox string, time string, dims url.Values) (image.Image, error) {
+	return fetchWmsMap(ctx, wms, bbox, TILE_SIZE, TILE_SIZE, time, dims)
+}
+
+// fetchWmsMap requests an arbitrary width x height image covering bbox. When
+// the time-fallback option is on, a failed timestamped request is retried
+// once without TIME so the image still renders during upstream
+// inconsistencies.
+func fetchWmsMap(ctx context.Context, wms WMSInfo, bbox string, width, height int, time string, dims url.Values) (image.Image, error) {
+	img, err := fetchWmsImage(ctx, wms, bbox, width, height, time, dims)
+	if err != nil && time != "" && config.TimeFallback {
+		logf(ctx, "GetMap for %s at %s failed (%v), falling back to default frame", wms.LayerName, time, err)
+		return fetchWmsImage(ctx, wms, bbox, width, height, "", dims)
 	}
-	showAlerts, _ := strconv.ParseBool(query.Get("alerts"))
-	timestamp := query.Get("time")
-	if timestamp == "" {
-		timestamps, err := getTimestamps(area)
-		if err != nil || len(timestamps) == 0 {
-			http.Error(w, "Could not get latest timestamp", http.StatusInternalServerError)
-			return
+	return img, err
+}
+
+// fetchRadarMap fetches the radar layer over the EPSG:3857 extent m and,
+// with alerts, the hazards layer alongside it so the two requests overlap.
+// A failed hazards fetch leaves the radar image on its own and is reported
+// as partial. A non-nil palette recolours the radar before the overlay goes
+// on. Extents crossing the antimeridian are fetched one world copy at a time
+// and stitched.
+func fetchRadarMap(ctx context.Context, radarInfo WMSInfo, m [4]float64, width, height int, time string, dims url.Values, palette []colormapEntry, alerts bool) (img image.Image, partial bool, err error) {
+	segments, err := wrapSegments(m, width)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(segments) == 1 && segments[0].X0 == 0 && segments[0].X1 == width {
+		return fetchLayers(ctx, radarInfo, mercatorBBox(segments[0].Bounds, width), width, height, time, dims, palette, alerts)
+	}
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	for _, segment := range segments {
+		segmentWidth := segment.X1 - segment.X0
+		img, missing, err := fetchLayers(ctx, radarInfo, mercatorBBox(segment.Bounds, segmentWidth), segmentWidth, height, time, dims, palette, alerts)
+		if err != nil {
+			return nil, false, err
 		}
-		timestamp = timestamps[len(timestamps)-1]
+		partial = partial || missing
+		draw.Draw(out, image.Rect(segment.X0, 0, segment.X1, height), img, img.Bounds().Min, draw.Src)
 	}
+	return out, partial, nil
+}
 
-	radarInfo, _ := radarLayers[area]
-	bbox := tileToBoundingBox(x, y, zoom)
-
-	radarImg, err := fetchWmsTile(radarInfo, bbox, timestamp)
+// fetchLayers is fetchRadarMap for an extent within the world, which bbox
+// requests of each layer.
+func fetchLayers(ctx context.Context, radarInfo WMSInfo, bbox layerBBox, width, height int, time string, dims url.Values, palette []colormapEntry, alerts bool) (image.Image, bool, error) {
+	var alertsImg image.Image
+	var alertsErr error
+	var wg sync.WaitGroup
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if alerts {
+		wg.Go(func() {
+			hazards, hazardsBBox := bbox(hazardsLayer)
+			alertsImg, alertsErr = fetchWmsMap(ctx, hazards, hazardsBBox, width, height, time, nil)
+		})
+	}
+	radar, radarBBox := bbox(radarInfo)
+	img, err := fetchWmsMap(ctx, radar, radarBBox, width, height, time, dims)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		// The overlay is useless without the radar.
+		cancel()
 	}
-
-	if showAlerts {
-		alertsImg, err := fetchWmsTile(hazardsLayer, bbox, timestamp)
-		if err == nil {
-			composite := image.NewRGBA(radarImg.Bounds())
-			draw.Draw(composite, composite.Bounds(), radarImg, image.Point{}, draw.Src)
-			draw.Draw(composite, composite.Bounds(), alertsImg, image.Point{}, draw.Over)
-			radarImg = composite
-		}
+	wg.Wait()
+	if err != nil {
+		return nil, false, err
 	}
+	if palette != nil {
+		img = recolor(img, palette)
+	}
+	if alerts && alertsErr != nil {
+		logf(ctx, "Rendering without alerts: %v", alertsErr)
+		return img, true, nil
+	}
+	if alerts {
+		img = compositeOver(img, alertsImg)
+	}
+	return img, false, nil
+}
 
-	w.Header().Set("Content-Type", "image/png")
-	png.Encode(w, radarImg)
+// getMapURL builds the GetMap request URL for a width x height image.
+func getMapURL(wms WMSInfo, bbox string, width, height int, time string, dims url.Values) string {
+	return fmt.Sprintf("%s?%s", wms.URL, getMapParams(wms, bbox, width, height, time, dims).Encode())
 }
 
-func main() {
-	http.HandleFunc("/tiles/", tileHandler)
-	http.HandleFunc("/frames", framesHandler)
-	port := "8080"
-	log.Printf("wmsproxy started on %s", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+// getMapParams builds the GetMap query parameters for a width x height image.
+func getMapParams(wms WMSInfo, bbox string, width, height int, time string, dims url.Values) url.Values {
+	params := url.Values{}
+	params.Add("SERVICE", "WMS")
+	params.Add("VERSION", wms.version())
+	params.Add("REQUEST", "GetMap")
+	params.Add("FORMAT", wms.format())
+	params.Add("TRANSPARENT", "true")
+	params.Add("LAYERS", wms.LayerName)
+	params.Add("WIDTH", strconv.Itoa(width))
+	params.Add("HEIGHT", strconv.Itoa(height))
+	// WMS 1.1.1 names the projection parameter SRS.
+	if wms.version() == "1.1.1" {
+		params.Add("SRS", wms.crs())
+	} else {
+		params.Add("CRS", wms.crs())
+	}
+	params.Add("BBOX", bbox)
+	if time != "" {
+		params.Add("TIME", wms.formatTime(time))
+	}
+	for name, values := range dims {
+		params[name] = values
+	}
+	return params
+}
+
+// newGetMapRequest builds a GetMap request. Requests whose URL would exceed
+// the configured threshold are sent as a form-encoded POST so servers with
+// URL length limits still accept them.
+func newGetMapRequest(ctx context.Context, wms WMSInfo, bbox string, width, height int, time string, dims url.Values) (*http.Request, error) {
+	params := getMapParams(wms, bbox, width, height, time, dims)
+	wmsURL := fmt.Sprintf("%s?%s", wms.URL, params.Encode())
+	var req *http.Request
+	var err error
+	if config.PostThreshold <= 0 || len(wmsURL) <= config.PostThreshold {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, wmsURL, nil)
+	} else if req, err = http.NewRequestWithContext(ctx, http.MethodPost, wms.URL, strings.NewReader(params.Encode())); err == nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if err != nil {
+		return nil, err
 	}
+	setRequestIDHeader(ctx, req)
+	setForwardedHeaders(ctx, req)
+	return req, nil
 }
 
+func fetchWmsImage(ctx context.Context, wms WMSInfo, bbox string, width, height int, time string, dims url.Values) (img image.Image, err error) {
+	area := layerArea(wms)
+	timer := prometheus.NewTimer(promUpstreamDuration.WithLabelValues(area))
+	defer timer.ObserveDuration()
+	defer trackUpstreamTime(ctx)()
+	defer func() {
+		if err != nil {
+			metrics.upstreamErrors.Add(1)
+		}
+		// Requests abandoned by the client say nothing about upstream.
+		if ctx.Err() == nil {
+			recordUpstream(wms.URL, err)
+			recordUpstreamRequest(area, "GetMap", err)
+		}
+	}()
+
+	slot, err := acquireUpstream(ctx)
+	defer slot.release()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doWithRetry(ctx, area, "GetMap", slot, func() (*http.Request, error) {
+		return newGetMapRequest(ctx, wms, bbox, width, height, time, dims)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent && wms.NoContentIsEmpty {
+		return image.NewRGBA(image.Rect(0, 0, width, height)), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("WMS server returned status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// WMS servers report errors as XML with a 200 status. Any image/* type,
+	// including variants like "image/png; mode=8bit", is left to the decoder.
+	if ct := resp.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(strings.ToLower(ct), "image/") {
+		return nil, serviceException(wms, ct, body)
+	}
+	return decodeLayerImage(wms, body)
+}
+
+// serviceException builds an error from a non-image GetMap response,
+// quoting the ServiceException message when the body is one.
+func serviceException(wms WMSInfo, contentType string, body []byte) error {
+	var report struct {
+		Exceptions []struct {
+			Code string `xml:"code,attr"`
+			Text string `xml:",chardata"`
+		} `xml:"ServiceException"`
+	}
+	if err := xml.Unmarshal(body, &report); err == nil && len(report.Exceptions) > 0 {
+		e := report.Exceptions[0]
+		return fmt.Errorf("layer %s returned a service exception %s: %s", wms.LayerName, e.Code, strings.TrimSpace(e.Text))
+	}
+	return fmt.Errorf("layer %s returned %s instead of an image", wms.LayerName, contentType)
+}
+
+// lenientPNGDecode is a more forgiving PNG decoder tried when the standard
+// library rejects a response. It is only compiled in with the lenientpng
+// build tag and must also be enabled with -png-fallback.
+var lenientPNGDecode func([]byte) (image.Image, error)
+
+// decodeLayerImage decodes a GetMap response, checking that it is in the
+// format the layer is configured for. A mismatch, or an animated GIF that
+// image.Decode would silently reduce to its first frame, points at a
+// misconfigured layer and is reported as an error.
+func decodeLayerImage(wms WMSInfo, body []byte) (image.Image, error) {
+	img, format, err := image.Decode(bytes.NewReader(body))
+	if err != nil && config.PNGFallback && lenientPNGDecode != nil && wms.format() == "image/png" {
+		img, fallbackErr := lenientPNGDecode(body)
+		if fallbackErr != nil {
+			return nil, err
+		}
+		log.Printf("Lenient PNG decoder recovered a tile from %s that failed to decode: %v", wms.LayerName, err)
+		return img, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if expected := strings.TrimPrefix(wms.format(), "image/"); format != expected {
+		return nil, fmt.Errorf("layer %s returned %s, expected %s", wms.LayerName, format, expected)
+	}
+	if format == "gif" && !config.GIFFirstFrame {
+		anim, err := gif.DecodeAll(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if len(anim.Image) > 1 {
+			return nil, fmt.Errorf("layer %s returned an animated GIF with %d frames", wms.LayerName, len(anim.Image))
+		}
+	}
+	return img, nil
+}
+
+// compositeOver draws overlay on top of base and returns the result.
+func compositeOver(base, overlay image.Image) image.Image {
+	composite := image.NewRGBA(base.Bounds())
+	draw.Draw(composite, composite.Bounds(), base, base.Bounds().Min, draw.Src)
+	draw.Draw(composite, composite.Bounds(), overlay, overlay.Bounds().Min, draw.Over)
+	return composite
+}
+
+// --- HTTP Handlers ---
+
+// setRetryAfter sets Retry-After to base plus a random jitter of up to
+// config.RetryJitter, so clients turned away together do not all retry at
+// the same moment.
+func setRetryAfter(w http.ResponseWriter, base time.Duration) {
+	if config.RetryJitter > 0 {
+		base += rand.N(config.RetryJitter)
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(base.Seconds()))))
+}
+
+// checkDuplicateParams rejects queries that repeat a parameter with
+// conflicting values. url.Values.Get silently takes the first value, which
+// hides mistakes from clients that think they overrode a parameter.
+// Repeating a parameter with the same value is harmless and allowed.
+func checkDuplicateParams(query url.Values) error {
+	for name, values := range query {
+		for _, v := range values[1:] {
+			if v != values[0] {
+				return fmt.Errorf("conflicting values for parameter %q", name)
+			}
+		}
+	}
+	return nil
+}
+
+// parseBoolParam reads a boolean query parameter, returning def when it is
+// absent. true/false, 1/0, yes/no and on/off are accepted in any case;
+// anything else is an error rather than silently false.
+func parseBoolParam(query url.Values, name string, def bool) (bool, error) {
+	v := query.Get(name)
+	switch strings.ToLower(v) {
+	case "":
+		return def, nil
+	case "true", "1", "yes", "on":
+		return true, nil
+	case "false", "0", "no", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid %s: %s", name, v)
+}
+
+// areaParam returns the requested area, conus by default. Area names are
+// lowercase, and values like "CONUS" or "conus/" are normalized to them.
+func areaParam(query url.Values) string {
+	area := strings.ToLower(strings.Trim(query.Get("area"), " \t/"))
+	if area == "" {
+		return "conus"
+	}
+	return area
+}
+
+// alertsRequested reports whether a request wants the hazards overlay. An
+// explicit ?alerts= wins; otherwise the area's default applies.
+func alertsRequested(query url.Values, area string) (bool, error) {
+	return parseBoolParam(query, "alerts", radarLayers[area].DefaultAlerts)
+}
+
+func framesHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if err := checkDuplicateParams(query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	area := areaParam(query)
+
+	// Bursts of pollers for the plain list share one encoded body.
+	since := query.Get("since")
+	data, found := []byte(nil), false
+	if since == "" {
+		data, found = getCoalescedFrames(timestampsKey(r.Context(), area))
+	}
+	if !found {
+		timestamps, err := getTimestamps(r.Context(), area)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var body any = timestamps
+		if since != "" {
+			body = frameDeltaSince(r.Context(), area, since)
+		}
+		if data, err = json.Marshal(body); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data = append(data, '\n')
+		if since == "" {
+			putCoalescedFrames(timestampsKey(r.Context(), area), data)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	setFramesCaching(r.Context(), w, area)
+	w.Write(data)
+}
+
+// frameURL is one entry of a frame manifest.
+type frameURL struct {
+	Time string `json:"time"`
+	URL  string `json:"url"`
+}
+
+// frameURLs returns stable tile URL templates for an area's frames. Each
+// names its concrete timestamp rather than "latest", so every frame can be
+// cached immutably by browsers and CDNs. {z}, {x} and {y} are left for the
+// client to fill in.
+func frameURLs(area string, timestamps []string) []frameURL {
+	urls := make([]frameURL, len(timestamps))
+	for i, ts := range timestamps {
+		query := url.Values{"area": {area}, "time": {ts}}
+		urls[i] = frameURL{Time: ts, URL: "/tiles/{z}/{x}/{y}.png?" + query.Encode()}
+	}
+	return urls
+}
+
+// manifestHandler serves /frames/manifest, the per-frame tile URLs for an
+// area's animation.
+func manifestHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if err := checkDuplicateParams(query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	area := areaParam(query)
+	if _, ok := radarLayers[area]; !ok {
+		http.Error(w, "invalid area: "+area, http.StatusBadRequest)
+		return
+	}
+
+	timestamps, err := getTimestamps(r.Context(), area)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	setFramesCaching(r.Context(), w, area)
+	json.NewEncoder(w).Encode(frameURLs(area, timestamps))
+}
+
+// framesBodies is a sub-second micro-cache of encoded /frames responses per
+// area. It collapses bursts of clients polling on the same cadence into a
+// single lookup and JSON encoding.
+var (
+	framesBodies      = make(map[string]tileCacheEntry)
+	framesBodiesMutex = &sync.Mutex{}
+)
+
+func getCoalescedFrames(key string) ([]byte, bool) {
+	if config.FramesCoalesce <= 0 {
+		return nil, false
+	}
+	framesBodiesMutex.Lock()
+	defer framesBodiesMutex.Unlock()
+	entry, found := framesBodies[key]
+	if !found || time.Now().After(entry.Expiry) {
+		return nil, false
+	}
+	return entry.Data, true
+}
+
+func putCoalescedFrames(key string, data []byte) {
+	if config.FramesCoalesce <= 0 {
+		return
+	}
+	framesBodiesMutex.Lock()
+	framesBodies[key] = tileCacheEntry{Data: data, Expiry: time.Now().Add(config.FramesCoalesce)}
+	framesBodiesMutex.Unlock()
+}
+
+// frameDelta describes how the frame list changed since a client's last poll.
+type frameDelta struct {
+	Latest  string   `json:"latest"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	// Reset is set when the client's timestamp is unknown; Added then holds
+	// the full current list and the client should replace its own.
+	Reset bool `json:"reset,omitempty"`
+}
+
+// frameDeltaSince compares the current frame window with the window a client
+// held when since was its latest frame.
+func frameDeltaSince(ctx context.Context, area, since string) frameDelta {
+	cacheMutex.RLock()
+	entry := cache[timestampsKey(ctx, area)]
+	cacheMutex.RUnlock()
+
+	current := entry.Timestamps
+	delta := frameDelta{Added: []string{}, Removed: []string{}}
+	if len(current) > 0 {
+		delta.Latest = current[len(current)-1]
+	}
+
+	i := slices.Index(entry.All, since)
+	if i < 0 {
+		delta.Added = current
+		delta.Reset = true
+		return delta
+	}
+	previous := entry.All[max(0, i+1-len(current)) : i+1]
+	for _, ts := range current {
+		if !slices.Contains(previous, ts) {
+			delta.Added = append(delta.Added, ts)
+		}
+	}
+	for _, ts := range previous {
+		if !slices.Contains(current, ts) {
+			delta.Removed = append(delta.Removed, ts)
+		}
+	}
+	return delta
+}
+
+// tileRequest is the normalized identity of a tile. Requests that differ
+// only in parameter order or in spelling out defaults normalize to the same
+// tileRequest and therefore share a cache entry.
+type tileRequest struct {
+	Area    string
+	Z, X, Y int
+	// CRS is the tileGrids entry the coordinates are in. It is empty for
+	// the default Web Mercator grid.
+	CRS       string
+	Time      string
+	Alerts    bool
+	Mask      string
+	Basemap   string
+	Invert    bool
+	Elevation string
+	Opacity   float64
+	Bearing   float64
+	// Brightness and Contrast adjust the radar's colours; 0 and 1 leave
+	// them unchanged.
+	Brightness float64
+	Contrast   float64
+	// Palette names an entry of radarPalettes to recolour the radar with.
+	Palette string
+	Format  string
+	// Scale multiplies the output pixel size for high-DPI displays. The
+	// tile still covers its usual extent.
+	Scale int
+	// Metadata embeds EXIF metadata in JPEG tiles.
+	Metadata bool
+	// Freshness is the data-freshness bucket to mark the tile with. It is
+	// resolved at request time so the tile cache splits on it.
+	Freshness string
+	// Degraded renders without optional overlays and with fast
+	// compression, when the proxy is overloaded.
+	Degraded bool
+	// Forwarded is the forwardedKey of the client headers the tile is
+	// fetched with.
+	Forwarded string
+	// NoCache re-renders the tile instead of reading it from the cache. It
+	// leaves the bytes unchanged, so it is the one field left out of cacheKey.
+	NoCache bool
+}
+
+// cacheKey returns the tile cache key for the request. Every field takes
+// part, so options that change the rendered bytes must live on tileRequest.
+func (t tileRequest) cacheKey() string {
+	t.NoCache = false
+	return fmt.Sprintf("%+v", t)
+}
+
+// grid returns the tiling scheme the tile is addressed in.
+func (t tileRequest) grid() tileGrid {
+	return tileGrids[cmp.Or(t.CRS, "EPSG:3857")]
+}
+
+// lonLatBounds returns the tile's west, south, east, north extent in
+// degrees.
+func (t tileRequest) lonLatBounds() [4]float64 {
+	if t.CRS == "EPSG:4326" {
+		return geographicTileBounds(t.X, t.Y, t.Z)
+	}
+	return lonLatBounds(tileToBoundingBox(t.X, t.Y, t.Z))
+}
+
+// pixelSize returns the side of the rendered tile in pixels.
+func (t tileRequest) pixelSize() int {
+	return TILE_SIZE * max(t.Scale, 1)
+}
+
+// dimensions returns the extra WMS dimension parameters for the radar layer.
+func (t tileRequest) dimensions() url.Values {
+	if t.Elevation == "" {
+		return nil
+	}
+	return url.Values{"ELEVATION": {t.Elevation}}
+}
+
+// parseTileCoords reads the coordinates of a tile route, registered as
+// .../{z}/{x}/{file} since a pattern wildcard must fill a whole segment.
+// The file is the row followed by one of exts; other files are not found.
+// Columns wrap around the antimeridian in grid; zoom and row must be in
+// range. With ?scheme=tms rows count from the south, as in TMS, and are
+// flipped to the XYZ row returned.
+func parseTileCoords(r *http.Request, grid tileGrid, exts ...string) (z, x, y, status int, err error) {
+	file := r.PathValue("file")
+	row, found := "", false
+	for _, ext := range exts {
+		if row, found = strings.CutSuffix(file, ext); found {
+			break
+		}
+	}
+	if !found {
+		return 0, 0, 0, http.StatusNotFound, fmt.Errorf("unknown tile file %q; expected {y}%s", file, strings.Join(exts, " or {y}"))
+	}
+	var coords [3]int
+	for i, part := range []string{r.PathValue("z"), r.PathValue("x"), row} {
+		if coords[i], err = strconv.Atoi(part); err != nil {
+			return 0, 0, 0, http.StatusBadRequest, fmt.Errorf("invalid tile coordinate %q", part)
+		}
+	}
+	z, x, y = coords[0], coords[1], coords[2]
+	if err := checkTileRange(z, y); err != nil {
+		return 0, 0, 0, http.StatusBadRequest, err
+	}
+	switch scheme := r.URL.Query().Get("scheme"); scheme {
+	case "", "xyz":
+	case "tms":
+		y = 1<<z - 1 - y
+	default:
+		return 0, 0, 0, http.StatusBadRequest, fmt.Errorf("invalid scheme: %s", scheme)
+	}
+	return z, grid.wrapX(x, z), y, http.StatusOK, nil
+}
+
+// checkTileRange checks that a tile's zoom and row exist. Columns wrap
+// around the antimeridian, so any is valid.
+func checkTileRange(z, y int) error {
+	if z < 0 || z > MAX_ZOOM {
+		return fmt.Errorf("zoom %d out of range (0-%d)", z, MAX_ZOOM)
+	}
+	if n := 1 << z; y < 0 || y >= n {
+		return fmt.Errorf("tile row %d out of range at zoom %d (0-%d)", y, z, n-1)
+	}
+	return nil
+}
+
+// parseTileRequest normalizes a tile request: the area falls back to conus,
+// the alerts flag is reduced to a bool and an omitted time is resolved to the
+// concrete latest timestamp.
+func parseTileRequest(r *http.Request) (tileRequest, int, error) {
+	var t tileRequest
+	var status int
+	var err error
+	if t.CRS = r.URL.Query().Get("crs"); t.CRS == "EPSG:3857" {
+		t.CRS = ""
+	}
+	grid, ok := tileGrids[cmp.Or(t.CRS, "EPSG:3857")]
+	if !ok {
+		return t, http.StatusBadRequest, fmt.Errorf("unsupported crs: %s", t.CRS)
+	}
+	t.Z, t.X, t.Y, status, err = parseTileCoords(r, grid, "@2x.png", "@2x.json", ".png", ".json")
+	if err != nil {
+		return t, status, err
+	}
+	t.Scale = 1
+	if strings.Contains(r.PathValue("file"), "@2x.") {
+		t.Scale = 2
+	}
+
+	query := r.URL.Query()
+	if err := checkDuplicateParams(query); err != nil {
+		return t, http.StatusBadRequest, err
+	}
+	t.Area = areaParam(query)
+	if t.Alerts, err = alertsRequested(query, t.Area); err != nil {
+		return t, http.StatusBadRequest, err
+	}
+	t.Mask = query.Get("mask")
+	if t.Mask != "" && !validMaskName(t.Mask) {
+		return t, http.StatusBadRequest, fmt.Errorf("invalid mask: %s", t.Mask)
+	}
+	if t.Invert, err = parseBoolParam(query, "invert", false); err != nil {
+		return t, http.StatusBadRequest, err
+	}
+	format, err := parseFormat(query, tileFormats)
+	if err != nil {
+		return t, http.StatusBadRequest, err
+	}
+	t.Format = format
+	if v := query.Get("scale"); v != "" {
+		scale, err := strconv.Atoi(v)
+		if err != nil || scale < 1 || scale > MAX_TILE_SCALE || (t.Scale != 1 && scale != t.Scale) {
+			return t, http.StatusBadRequest, fmt.Errorf("invalid scale: %s", v)
+		}
+		t.Scale = scale
+	}
+	if t.Metadata, err = parseMetadata(query, format); err != nil {
+		return t, http.StatusBadRequest, err
+	}
+	t.Opacity = 1
+	if v := query.Get("opacity"); v != "" {
+		opacity, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(opacity) {
+			return t, http.StatusBadRequest, fmt.Errorf("invalid opacity: %s", v)
+		}
+		t.Opacity = max(0, min(opacity, 1))
+	}
+	if v := query.Get("brightness"); v != "" {
+		brightness, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(brightness) {
+			return t, http.StatusBadRequest, fmt.Errorf("invalid brightness: %s", v)
+		}
+		t.Brightness = max(-1, min(brightness, 1))
+	}
+	t.Contrast = 1
+	if v := query.Get("contrast"); v != "" {
+		contrast, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(contrast) {
+			return t, http.StatusBadRequest, fmt.Errorf("invalid contrast: %s", v)
+		}
+		t.Contrast = max(0, min(contrast, MAX_CONTRAST))
+	}
+	t.Palette = query.Get("palette")
+	if _, ok := radarPalettes[t.Palette]; t.Palette != "" && !ok {
+		return t, http.StatusBadRequest, fmt.Errorf("invalid palette: %s", t.Palette)
+	}
+	if v := query.Get("bearing"); v != "" {
+		bearing, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(bearing) || math.IsInf(bearing, 0) {
+			return t, http.StatusBadRequest, fmt.Errorf("invalid bearing: %s", v)
+		}
+		// Normalized so equivalent bearings share a cache entry.
+		t.Bearing = math.Mod(math.Mod(bearing, 360)+360, 360)
+	}
+	if t.Elevation = query.Get("elevation"); t.Elevation != "" {
+		wms, ok := radarLayers[t.Area]
+		if !ok {
+			return t, http.StatusBadRequest, fmt.Errorf("invalid area: %s", t.Area)
+		}
+		if len(wms.Elevations) == 0 {
+			return t, http.StatusBadRequest, fmt.Errorf("area %s does not support elevation", t.Area)
+		}
+		if !slices.Contains(wms.Elevations, t.Elevation) {
+			return t, http.StatusBadRequest, fmt.Errorf("invalid elevation %s; valid values: %s", t.Elevation, strings.Join(wms.Elevations, ", "))
+		}
+	}
+	t.Basemap = query.Get("basemap")
+	if t.Basemap != "" && t.Basemap != "osm" {
+		return t, http.StatusBadRequest, fmt.Errorf("invalid basemap: %s", t.Basemap)
+	}
+	if t.Bearing != 0 && (t.Basemap != "" || t.Mask != "") {
+		return t, http.StatusBadRequest, fmt.Errorf("bearing cannot be combined with basemap or mask")
+	}
+	if t.CRS != "" && (t.Bearing != 0 || t.Basemap != "" || t.Mask != "") {
+		return t, http.StatusBadRequest, fmt.Errorf("crs %s cannot be combined with bearing, basemap or mask", t.CRS)
+	}
+	if t.NoCache, err = parseBoolParam(query, "nocache", false); err != nil {
+		return t, http.StatusBadRequest, err
+	}
+	t.Forwarded = forwardedKey(r.Context())
+	lookup := getTimestamps
+	if t.NoCache {
+		lookup = getUncachedTimestamps
+	}
+	if requested := query.Get("time"); requested != "" && requested != "now" {
+		if t.Time, err = resolveTime(r.Context(), t.Area, requested, lookup); err != nil {
+			return t, http.StatusBadRequest, err
+		}
+	} else {
+		timestamps, err := lookup(r.Context(), t.Area)
+		if err != nil || len(timestamps) == 0 {
+			return t, http.StatusInternalServerError, fmt.Errorf("Could not get latest timestamp")
+		}
+		if requested == "now" {
+			t.Time = latestPastTimestamp(timestamps, time.Now())
+		} else {
+			t.Time = timestamps[len(timestamps)-1]
+		}
+	}
+	freshness, err := parseBoolParam(query, "freshness", false)
+	if err != nil {
+		return t, http.StatusBadRequest, err
+	}
+	if freshness {
+		t.Freshness = freshnessBucket(t.Time, time.Now())
+	}
+	return t, http.StatusOK, nil
+}
+
+// latestPastTimestamp returns the newest timestamp not after now, skipping
+// near-future nowcast frames some servers advertise. If every frame is in
+// the future, or none parse, the newest frame is returned.
+func latestPastTimestamp(timestamps []string, now time.Time) string {
+	for i := len(timestamps) - 1; i >= 0; i-- {
+		if t, err := time.Parse(time.RFC3339, timestamps[i]); err == nil && !t.After(now) {
+			return timestamps[i]
+		}
+	}
+	return timestamps[len(timestamps)-1]
+}
+
+// resolveTime resolves a tile's explicit ?time= against every frame the
+// area's capabilities list, not just the recent window. A known frame is used
+// without a lookup. Other times are snapped with nearestTimestamp once
+// lookup has refreshed the list, or used as given if it can't be fetched.
+func resolveTime(ctx context.Context, area, requested string, lookup func(context.Context, string) ([]string, error)) (string, error) {
+	if _, err := time.Parse(time.RFC3339, requested); err != nil {
+		return "", fmt.Errorf("invalid time: %s", requested)
+	}
+	if slices.Contains(allTimestamps(ctx, area), requested) {
+		return requested, nil
+	}
+	if _, err := lookup(ctx, area); err != nil {
+		logf(ctx, "Using unsnapped time %s for '%s': %v", requested, area, err)
+		return requested, nil
+	}
+	return nearestTimestamp(allTimestamps(ctx, area), requested)
+}
+
+// allTimestamps returns every cached frame of an area, oldest first.
+func allTimestamps(ctx context.Context, area string) []string {
+	cacheMutex.RLock()
+	defer cacheMutex.RUnlock()
+	return cache[timestampsKey(ctx, area)].All
+}
+
+// nearestTimestamp snaps requested, an RFC 3339 time, to the closest of
+// timestamps, so clients needn't know the exact frame times. Frames further
+// than config.TimeMaxSkew away don't match.
+func nearestTimestamp(timestamps []string, requested string) (string, error) {
+	want, err := time.Parse(time.RFC3339, requested)
+	if err != nil {
+		return "", fmt.Errorf("invalid time: %s", requested)
+	}
+	var nearest string
+	var skew time.Duration
+	for _, ts := range timestamps {
+		t, err := time.Parse(time.RFC3339, ts)
+		if err != nil {
+			continue
+		}
+		if d := t.Sub(want).Abs(); nearest == "" || d < skew {
+			nearest, skew = ts, d
+		}
+	}
+	if nearest == "" || skew > config.TimeMaxSkew {
+		return "", fmt.Errorf("no frame within %s of %s", config.TimeMaxSkew, requested)
+	}
+	return nearest, nil
+}
+
+func tileHandler(w http.ResponseWriter, r *http.Request) {
+	tile, status, err := parseTileRequest(r)
+	tileLogFor(r).Tile = tile
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	// Data URIs are a third larger than the image, so the JSON variant must
+	// be asked for explicitly.
+	asJSON := strings.HasSuffix(r.URL.Path, ".json")
+	if asJSON && r.URL.Query().Get("encode") != "dataurl" {
+		http.Error(w, "JSON tiles require encode=dataurl", http.StatusBadRequest)
+		return
+	}
+
+	if d := r.URL.Query().Get("delay"); d != "" {
+		delay, err := parseDelay(d)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	w.Header().Set("X-Radar-Timestamp", tile.Time)
+	if t := r.URL.Query().Get("time"); config.NextFrameHeader && (t == "" || t == "now") {
+		if wait, ok := nextFrameIn(r.Context(), tile.Area, tile.Time, time.Now()); ok {
+			w.Header().Set("X-Next-Frame-In", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		}
+	}
+	if tile.Basemap != "" && config.BasemapAttribution != "" {
+		w.Header().Set("X-Attribution", config.BasemapAttribution)
+	}
+
+	// The validators follow from the request alone, so a client that already
+	// holds the current frame is answered without rendering it.
+	etag, modified := tileETag(tile, asJSON), frameTime(tile.Time)
+	if notModified(r, etag, modified) {
+		tileLogFor(r).Cache = "NOT-MODIFIED"
+		setTileValidators(w, etag, modified)
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	result, status, err := tileBytes(r.Context(), tile)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	recordTileServed(tile.Z)
+	tileLogFor(r).Cache = result.Source
+
+	// Frames requested by their exact timestamp never change, so they can be
+	// cached indefinitely; the latest frame, or a time snapped to a frame,
+	// until the next one is due.
+	// Blanks from upstream failures, and tiles missing their alerts, must
+	// only be cached briefly so clients pick up the real tile after recovery,
+	// and carry no validators. So must degraded tiles, so clients return for
+	// full quality once the load has passed.
+	switch {
+	case result.Negative || result.Partial:
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(max(config.NegativeTTL, BLANK_TILE_MAX_AGE).Seconds())))
+	case result.Degraded:
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(DEGRADED_TILE_MAX_AGE.Seconds())))
+	default:
+		// A freshness dot changes with the frame's age, so it may only be
+		// kept until its colour would. As in tileTTL, -time-fallback tiles
+		// may hold the server's default frame and are never immutable.
+		if r.URL.Query().Get("time") == tile.Time && tile.Freshness == "" && !config.TimeFallback {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else if !timestampsStale(r.Context(), tile.Area) {
+			maxAge := time.Until(cacheExpiry(r.Context(), tile.Area))
+			if change, ok := freshnessChange(tile.Time, time.Now()); ok && tile.Freshness != "" {
+				maxAge = min(maxAge, time.Until(change))
+			}
+			w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", max(int(maxAge.Seconds()), 0)))
+		}
+		setTileValidators(w, etag, modified)
+	}
+	w.Header().Set("X-Cache", result.Source)
+	if result.Degraded {
+		w.Header().Set("X-Quality", "degraded")
+	}
+	if asJSON {
+		writeTileDataURI(w, tile, result.Data)
+		return
+	}
+	w.Header().Set("Content-Type", contentType(tile.Format))
+	w.Write(result.Data)
+}
+
+// tileETag returns the entity tag of a tile. It hashes the cache key, which
+// covers the area, coordinates, frame and every rendering option.
+func tileETag(tile tileRequest, asJSON bool) string {
+	h := fnv.New64a()
+	io.WriteString(h, tile.cacheKey())
+	if asJSON {
+		io.WriteString(h, ".json")
+	}
+	return fmt.Sprintf(`"%x"`, h.Sum64())
+}
+
+// frameTime parses a frame timestamp, returning the zero time if it isn't
+// RFC 3339.
+func frameTime(timestamp string) time.Time {
+	t, _ := time.Parse(time.RFC3339, timestamp)
+	return t
+}
+
+func setTileValidators(w http.ResponseWriter, etag string, modified time.Time) {
+	w.Header().Set("ETag", etag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified reports whether a conditional request already holds the
+// representation. If-None-Match takes precedence over If-Modified-Since.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for tag := range strings.SplitSeq(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == etag || tag == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if modified.IsZero() {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.Truncate(time.Second).After(since)
+}
+
+// writeTileDataURI writes an encoded tile as JSON holding a base64 data
+// URI, for clients embedding it in their own responses. bbox is the tile's
+// west,south,east,north extent in degrees.
+func writeTileDataURI(w http.ResponseWriter, tile tileRequest, data []byte) {
+	b := tile.lonLatBounds()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"dataUri":   "data:" + contentType(tile.Format) + ";base64," + base64.StdEncoding.EncodeToString(data),
+		"timestamp": tile.Time,
+		"bbox":      fmt.Sprintf("%f,%f,%f,%f", b[0], b[1], b[2], b[3]),
+	})
+}
+
+// parseDelay parses the debug-only ?delay= parameter, e.g. "500ms". It is
+// rejected outright unless -debug is set.
+func parseDelay(s string) (time.Duration, error) {
+	if !config.Debug {
+		return 0, fmt.Errorf("delay requires the -debug flag")
+	}
+	delay, err := time.ParseDuration(s)
+	if err != nil || delay < 0 {
+		return 0, fmt.Errorf("invalid delay %q", s)
+	}
+	return min(delay, MAX_DEBUG_DELAY), nil
+}
+
+// Cache layers reported in the X-Cache header.
+const (
+	CACHE_HIT_MEMORY = "HIT-MEMORY"
+	CACHE_MISS       = "MISS"
+)
+
+// tileResult is an encoded tile. Negative marks a blank served in place of
+// a failed upstream fetch, Partial a tile missing its alerts overlay, and
+// Source is the cache layer it came from.
+type tileResult struct {
+	Data     []byte
+	Negative bool
+	Partial  bool
+	Degraded bool
+	Source   string
+}
+
+// tileBytes returns the encoded image for a tile, from the tile cache when
+// possible.
+func tileBytes(ctx context.Context, tile tileRequest) (tileResult, int, error) {
+	key := tile.cacheKey()
+	if entry, found := getCachedTile(key); found && !tile.NoCache {
+		metrics.cacheHits.Add(1)
+		promTileCache.WithLabelValues(tile.Area, "hit").Inc()
+		return tileResult{Data: entry.Data, Negative: entry.Negative, Partial: entry.Partial, Source: CACHE_HIT_MEMORY}, http.StatusOK, nil
+	}
+	// Under load, a degraded copy rendered earlier is as good as a fresh one.
+	if overloaded() {
+		tile.Degraded = true
+		key = tile.cacheKey()
+		metrics.degraded.Add(1)
+		if entry, found := getCachedTile(key); found && !tile.NoCache {
+			metrics.cacheHits.Add(1)
+			promTileCache.WithLabelValues(tile.Area, "hit").Inc()
+			return tileResult{Data: entry.Data, Negative: entry.Negative, Partial: entry.Partial, Degraded: true, Source: CACHE_HIT_MEMORY}, http.StatusOK, nil
+		}
+	}
+	metrics.cacheMisses.Add(1)
+	promTileCache.WithLabelValues(tile.Area, "miss").Inc()
+
+	// Concurrent misses for the same tile share one render, which is only
+	// cancelled once every caller has gone away.
+	v, err := tileFlight.do(ctx, key, func(ctx context.Context) (any, error) {
+		result, status, err := renderTileBytes(ctx, tile, key)
+		return renderOutcome{result, status}, err
+	})
+	outcome, ok := v.(renderOutcome)
+	if !ok {
+		return tileResult{}, http.StatusServiceUnavailable, err
+	}
+	return outcome.result, outcome.status, err
+}
+
+// renderOutcome carries renderTileBytes' results through tileFlight.
+type renderOutcome struct {
+	result tileResult
+	status int
+}
+
+var tileFlight sharedFlight
+
+// renderTileBytes renders and encodes a tile missing from the cache and
+// stores it under key.
+func renderTileBytes(ctx context.Context, tile tileRequest, key string) (tileResult, int, error) {
+	img, partial, status, err := renderTile(ctx, tile)
+	// Radar upstream failures are served as a transparent tile so map
+	// clients show the basemap instead of a broken tile. A client that went
+	// away is not an upstream outage.
+	var upstreamErr upstreamError
+	if errors.As(err, &upstreamErr) && ctx.Err() == nil {
+		logf(ctx, "Serving blank tile for %s/%d/%d/%d: %v", tile.Area, tile.Z, tile.X, tile.Y, err)
+		var buf bytes.Buffer
+		if err := encodeImage(&buf, genBlankTile(tile.pixelSize()), tile.Format); err != nil {
+			return tileResult{}, http.StatusInternalServerError, err
+		}
+		if config.NegativeTTL > 0 {
+			putNegativeTile(key, tile, buf.Bytes())
+		}
+		return tileResult{Data: buf.Bytes(), Negative: true, Source: CACHE_MISS}, http.StatusOK, nil
+	}
+	if err != nil {
+		return tileResult{}, status, err
+	}
+
+	var buf bytes.Buffer
+	if tile.Degraded && tile.Format == "png" {
+		err = fastPNG.Encode(&buf, img)
+	} else if tile.Metadata {
+		err = encodeJPEGWithMetadata(&buf, img, tile.Time, tile.lonLatBounds())
+	} else {
+		err = encodeImage(&buf, img, tile.Format)
+	}
+	if err != nil {
+		return tileResult{}, http.StatusInternalServerError, err
+	}
+	if partial {
+		if config.NegativeTTL > 0 {
+			putPartialTile(key, buf.Bytes())
+		}
+	} else {
+		putCachedTile(key, buf.Bytes(), tileTTL(tile.Time))
+	}
+	purgeNegativeTiles(tile.Area, tile.Z)
+	return tileResult{Data: buf.Bytes(), Partial: partial, Degraded: tile.Degraded, Source: CACHE_MISS}, http.StatusOK, nil
+}
+
+// blankTiles are the fully transparent tiles, indexed by ?scale=.
+var blankTiles = func() (tiles [MAX_TILE_SCALE + 1]*image.NRGBA) {
+	for scale := 1; scale <= MAX_TILE_SCALE; scale++ {
+		tiles[scale] = image.NewNRGBA(image.Rect(0, 0, scale*TILE_SIZE, scale*TILE_SIZE))
+	}
+	return tiles
+}()
+
+// genBlankTile returns the shared fully transparent tile of size pixels.
+// Callers must not modify it.
+func genBlankTile(size int) *image.NRGBA {
+	return blankTiles[size/TILE_SIZE]
+}
+
+// upstreamError marks a render failure caused by the radar upstream, as
+// opposed to a bad request or local problem.
+type upstreamError struct{ err error }
+
+func (e upstreamError) Error() string { return e.err.Error() }
+func (e upstreamError) Unwrap() error { return e.err }
+
+// renderTile fetches a tile's layers and applies its rendering options. It
+// reports whether the image is partial, missing its alerts overlay.
+func renderTile(ctx context.Context, tile tileRequest) (image.Image, bool, int, error) {
+	radarInfo, ok := radarLayers[tile.Area]
+	if !ok {
+		return nil, false, http.StatusBadRequest, fmt.Errorf("invalid area: %s", tile.Area)
+	}
+	size := tile.pixelSize()
+	palette, alerts := radarPalettes[tile.Palette], tile.Alerts && !tile.Degraded
+	var radarImg image.Image
+	var partial bool
+	var err error
+	if tile.Bearing != 0 {
+		// Rotated tiles are cut from a larger fetch so the corners are
+		// filled. They are only served on the Web Mercator grid.
+		bounds, fetchSize := bufferBounds(tileToBoundingBox(tile.X, tile.Y, tile.Z), size), rotatedFetchSize(size)
+		radarImg, partial, err = fetchRadarMap(ctx, radarInfo, bounds, fetchSize, fetchSize, tile.Time, tile.dimensions(), palette, alerts)
+	} else {
+		radarImg, partial, err = fetchLayers(ctx, radarInfo, tile.grid().bbox(tile.X, tile.Y, tile.Z, size), size, size, tile.Time, tile.dimensions(), palette, alerts)
+	}
+	if err != nil {
+		return nil, false, http.StatusInternalServerError, upstreamError{err}
+	}
+	if tile.Bearing != 0 {
+		radarImg = rotateToBearing(radarImg, tile.Bearing, size)
+	}
+	if tile.Brightness != 0 || tile.Contrast != 1 {
+		radarImg = adjustLevels(radarImg, tile.Brightness, tile.Contrast)
+	}
+
+	if tile.Mask != "" {
+		mask, err := tileMask(tile.Mask, tile.X, tile.Y, tile.Z, size)
+		if err != nil {
+			logf(ctx, "Could not load mask '%s': %v", tile.Mask, err)
+			return nil, false, http.StatusInternalServerError, fmt.Errorf("Could not load mask")
+		}
+		radarImg = applyMask(radarImg, mask)
+	}
+
+	if tile.Basemap != "" {
+		base, err := fetchBasemapTile(ctx, tile.X, tile.Y, tile.Z)
+		if err != nil {
+			logf(ctx, "Could not fetch basemap tile: %v", err)
+			return nil, false, http.StatusBadGateway, fmt.Errorf("Could not fetch basemap")
+		}
+		radarImg = compositeOver(resizeTile(base, size), radarImg)
+	}
+
+	if tile.Invert {
+		radarImg = invertColors(radarImg)
+	}
+	if tile.Opacity < 1 {
+		radarImg = scaleOpacity(radarImg, tile.Opacity)
+	}
+	if tile.Freshness != "" {
+		radarImg = drawFreshnessDot(radarImg, tile.Freshness)
+	}
+	return radarImg, partial, http.StatusOK, nil
+}
+
+func main() {
+	registerFlags()
+	flag.Usage = usage
+	if err := applyEnv(); err != nil {
+		log.Fatalf("Invalid environment: %v", err)
+	}
+	flag.Parse()
+	if err := setupLogging(); err != nil {
+		log.Fatalf("Invalid logging configuration: %v", err)
+	}
+	if config.Port == "" || config.CacheTTL <= 0 || config.Frames < 1 {
+		log.Fatalf("Invalid configuration: -port must be set, -cache-ttl positive and -frames at least 1")
+	}
+	if config.LayerConfig != "" {
+		if err := loadLayerConfig(config.LayerConfig); err != nil {
+			log.Fatalf("Invalid layer configuration: %v", err)
+		}
+	}
+	if err := ensureLayers(); err != nil {
+		log.Fatalf("Invalid layer configuration: %v", err)
+	}
+	if err := validateLayers(); err != nil {
+		log.Fatalf("Invalid layer configuration: %v", err)
+	}
+	if err := applyDefaultAlerts(config.DefaultAlerts); err != nil {
+		log.Fatalf("Invalid -default-alerts: %v", err)
+	}
+	if config.PNGFallback && lenientPNGDecode == nil {
+		log.Printf("-png-fallback has no effect: built without the lenientpng tag")
+	}
+	if config.FadeCurve != "linear" && config.FadeCurve != "exponential" {
+		log.Fatalf("Invalid -fade-curve %q: must be linear or exponential", config.FadeCurve)
+	}
+	if config.FadeMinAlpha <= 0 || config.FadeMinAlpha > 1 {
+		log.Fatalf("Invalid -fade-min-alpha %v: must be in (0, 1]", config.FadeMinAlpha)
+	}
+	if config.MaxFrames < 1 || config.MaxFramePixels < TILE_SIZE*TILE_SIZE {
+		log.Fatalf("Invalid frame limits: -max-frames must be at least 1 and -max-frame-pixels at least one tile")
+	}
+	if config.UpstreamAttempts < 1 || config.UpstreamRetryDelay < 0 {
+		log.Fatalf("Invalid upstream retries: -upstream-attempts must be at least 1 and -upstream-retry-delay not negative")
+	}
+	if config.ColormapCacheSize < 0 {
+		log.Fatalf("Invalid -colormap-cache-size %d: must not be negative", config.ColormapCacheSize)
+	}
+	if config.TimeMaxSkew < 0 {
+		log.Fatalf("Invalid -time-max-skew %s: must not be negative", config.TimeMaxSkew)
+	}
+	if config.MaxAnimations < 1 {
+		log.Fatalf("Invalid -max-animations %d: must be at least 1", config.MaxAnimations)
+	}
+	animationSlots = make(chan struct{}, config.MaxAnimations)
+	corsOrigins = parseCORSOrigins(config.CORSOrigins)
+	var err error
+	if forwardHeaders, err = parseForwardHeaders(config.ForwardHeaders); err != nil {
+		log.Fatalf("Invalid -forward-headers: %v", err)
+	}
+	if apiKeys, err = parseAPIKeys(config.APIKeys); err != nil {
+		log.Fatalf("Invalid -api-keys: %v", err)
+	}
+	if rateLimits, err = parseRateLimits(config.RateLimits); err != nil {
+		log.Fatalf("Invalid -rate-limits: %v", err)
+	}
+	if trustedProxies, err = parseTrustedProxies(config.TrustedProxies); err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
+	if config.MaxUpstreamRequests < 0 {
+		log.Fatalf("Invalid -max-upstream-requests %d: must not be negative", config.MaxUpstreamRequests)
+	} else if config.MaxUpstreamRequests > 0 {
+		upstreamSlots = make(chan struct{}, config.MaxUpstreamRequests)
+	}
+	if warmTiles, err = parseWarmTiles(config.WarmTiles); err != nil {
+		log.Fatalf("Invalid -warm-tiles: %v", err)
+	}
+	if config.UsageReset <= 0 {
+		log.Fatalf("Invalid -usage-reset %v: must be positive", config.UsageReset)
+	}
+	if config.Pregenerate {
+		if err := pregenerate(); err != nil {
+			log.Fatalf("Pregeneration failed: %v", err)
+		}
+		return
+	}
+	if config.ExportMBTiles != "" {
+		if err := exportMBTiles(config.ExportMBTiles); err != nil {
+			log.Fatalf("MBTiles export failed: %v", err)
+		}
+		return
+	}
+	workers.start("cache-sweeper", runCacheSweeper)
+	if config.Refresh {
+		workers.start("refresher", runRefresher)
+	}
+	if len(apiKeys) > 0 {
+		workers.start("usage-reset", runUsageReset)
+	}
+	if len(rateLimits) > 0 {
+		workers.start("limiter-sweep", runLimiterSweep)
+	}
+	if len(warmTiles) > 0 {
+		workers.start("warm-up", runWarmUp)
+	}
+
+	// Routes go on a mux of our own rather than http.DefaultServeMux, which
+	// imported packages such as expvar register debug endpoints on.
+	mux := http.NewServeMux()
+	public := func(path, class string, handler http.HandlerFunc) {
+		mux.HandleFunc("GET "+path, withCORS(rateLimit(class, requireAPIKey(handler))))
+		mux.HandleFunc("OPTIONS "+path, preflightHandler)
+	}
+	public("/tiles/{z}/{x}/{file}", "tiles", logTileRequests(tileHandler))
+	public("/frames", "frames", framesHandler)
+	public("/frames/manifest", "frames", manifestHandler)
+	public("/map", "map", mapHandler)
+	public("/poi", "map", poiHandler)
+	public("/card", "map", cardHandler)
+	public("/composite/max/{z}/{x}/{file}", "composite", maxCompositeHandler)
+	public("/animate/{z}/{x}/{file}", "composite", animateHandler)
+	mux.Handle("GET /metrics", promhttp.Handler())
+	mux.HandleFunc("GET /healthz", healthzHandler)
+	mux.HandleFunc("GET /readyz", readyzHandler)
+	mux.HandleFunc("GET /admin/probe", requireAdmin(probeHandler))
+	mux.HandleFunc("GET /admin/config", requireAdmin(configHandler))
+	mux.HandleFunc("GET /admin/usage", requireAdmin(usageHandler))
+	mux.HandleFunc("GET /admin/upstreams", requireAdmin(upstreamsHandler))
+	mux.HandleFunc("GET /admin/vars", requireAdmin(varsHandler))
+	server := &http.Server{Addr: ":" + config.Port, Handler: countTraffic(withRequestID(withForwardedHeaders(mux)))}
+
+	useTLS := config.TLSCert != "" || config.TLSKey != ""
+	if useTLS {
+		if server.TLSConfig, err = tlsConfig(); err != nil {
+			log.Fatalf("Invalid TLS configuration: %v", err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serveErr := make(chan error, 1)
+	go func() {
+		if useTLS {
+			log.Printf("wmsproxy started on %s (TLS)", config.Port)
+			serveErr <- server.ListenAndServeTLS(config.TLSCert, config.TLSKey)
+		} else {
+			log.Printf("wmsproxy started on %s", config.Port)
+			serveErr <- server.ListenAndServe()
+		}
+	}()
+
+	select {
+	case err := <-serveErr:
+		log.Fatalf("Failed to start server: %v", err)
+	case <-ctx.Done():
+		// A second signal kills the process as usual.
+		stop()
+		log.Printf("Shutdown signal received, draining in-flight requests")
+		if err := shutdown(server); err != nil {
+			log.Printf("Shutdown incomplete: %v", err)
+		}
+		log.Printf("wmsproxy stopped")
+	}
+}
@@ -0,0 +1,849 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"image"
+	"image/png"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useConfig restores the configuration once t ends, so tests may change it.
+func useConfig(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+}
+
+// useLayer serves area from wms for the duration of t.
+func useLayer(t *testing.T, area string, wms WMSInfo) {
+	saved, found := radarLayers[area]
+	radarLayers[area] = wms
+	t.Cleanup(func() {
+		if found {
+			radarLayers[area] = saved
+		} else {
+			delete(radarLayers, area)
+		}
+	})
+}
+
+// useCachedTimestamps caches entry for area for the duration of t.
+func useCachedTimestamps(t *testing.T, area string, entry CacheEntry) {
+	cacheMutex.Lock()
+	cache[area] = entry
+	cacheMutex.Unlock()
+	t.Cleanup(func() {
+		cacheMutex.Lock()
+		delete(cache, area)
+		cacheMutex.Unlock()
+	})
+}
+
+// useTileCache empties the tile cache for the duration of t.
+func useTileCache(t *testing.T) {
+	reset := func() {
+		tileCacheMutex.Lock()
+		clear(tileCache)
+		tileLRU.Init()
+		clear(negativeKeys)
+		tileCacheMutex.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// testTile is a plain tile request for area, bypassing the tile cache.
+func testTile(area string) tileRequest {
+	return tileRequest{
+		Area:     area,
+		Z:        5,
+		X:        8,
+		Y:        12,
+		Time:     "2025-01-01T00:00:00Z",
+		Format:   "png",
+		Scale:    1,
+		Opacity:  1,
+		Contrast: 1,
+		NoCache:  true,
+	}
+}
+
+// fullyTransparent reports whether every pixel of img is transparent.
+func fullyTransparent(img image.Image) bool {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// failingServer is a WMS server that answers every request with 503.
+func failingServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestExpandTimeDimension(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{
+			name: "single value",
+			text: "2025-01-01T00:00:00Z",
+			want: []string{"2025-01-01T00:00:00Z"},
+		},
+		{
+			name: "comma list",
+			text: "2025-01-01T00:00:00Z,2025-01-01T00:05:00Z, 2025-01-01T00:10:00Z",
+			want: []string{"2025-01-01T00:00:00Z", "2025-01-01T00:05:00Z", "2025-01-01T00:10:00Z"},
+		},
+		{
+			name: "interval",
+			text: "2025-01-01T00:00:00Z/2025-01-01T00:15:00Z/PT5M",
+			want: []string{"2025-01-01T00:00:00Z", "2025-01-01T00:05:00Z", "2025-01-01T00:10:00Z", "2025-01-01T00:15:00Z"},
+		},
+		{
+			name: "interval ending between periods",
+			text: "2025-01-01T00:00:00Z/2025-01-01T00:12:00Z/PT5M",
+			want: []string{"2025-01-01T00:00:00Z", "2025-01-01T00:05:00Z", "2025-01-01T00:10:00Z"},
+		},
+		{
+			name: "list and interval",
+			text: "2024-12-31T23:00:00Z,2025-01-01T00:00:00Z/2025-01-01T00:05:00Z/PT5M",
+			want: []string{"2024-12-31T23:00:00Z", "2025-01-01T00:00:00Z", "2025-01-01T00:05:00Z"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := expandTimeDimension(tt.text)
+			if err != nil {
+				t.Fatalf("expandTimeDimension(%q): %v", tt.text, err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("expandTimeDimension(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandTimeDimensionLongInterval(t *testing.T) {
+	// A year of minutes is far more than MAX_INTERVAL_FRAMES; the latest
+	// frames are kept.
+	got, err := expandTimeDimension("2024-01-01T00:00:00Z/2025-01-01T00:00:00Z/PT1M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != MAX_INTERVAL_FRAMES {
+		t.Fatalf("got %d timestamps, want %d", len(got), MAX_INTERVAL_FRAMES)
+	}
+	end := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	if want := end.Format(time.RFC3339); got[len(got)-1] != want {
+		t.Errorf("last timestamp = %s, want %s", got[len(got)-1], want)
+	}
+	if want := end.Add(-(MAX_INTERVAL_FRAMES - 1) * time.Minute).Format(time.RFC3339); got[0] != want {
+		t.Errorf("first timestamp = %s, want %s", got[0], want)
+	}
+}
+
+func TestExpandTimeDimensionInvalid(t *testing.T) {
+	for _, text := range []string{
+		"",
+		"2025-01-01T00:00:00Z/2025-01-01T01:00:00Z",
+		"2025-01-01T01:00:00Z/2025-01-01T00:00:00Z/PT5M",
+		"2025-01-01T00:00:00Z/2025-01-01T01:00:00Z/P1M",
+		"yesterday/2025-01-01T01:00:00Z/PT5M",
+	} {
+		if got, err := expandTimeDimension(text); err == nil {
+			t.Errorf("expandTimeDimension(%q) = %v, want error", text, got)
+		}
+	}
+}
+
+func TestCapabilitiesNamespaces(t *testing.T) {
+	docs := map[string]string{
+		"default namespace": `<?xml version="1.0" encoding="UTF-8"?>
+<WMS_Capabilities version="1.3.0" xmlns="http://www.opengis.net/wms" xmlns:xlink="http://www.w3.org/1999/xlink">
+  <Capability>
+    <Layer>
+      <Layer queryable="1">
+        <Name>conus_bref_qcd</Name>
+        <Dimension name="time" units="ISO8601">2025-01-01T00:00:00Z,2025-01-01T00:05:00Z</Dimension>
+      </Layer>
+    </Layer>
+  </Capability>
+</WMS_Capabilities>`,
+		"prefixed namespace": `<?xml version="1.0" encoding="UTF-8"?>
+<wms:WMS_Capabilities version="1.3.0" xmlns:wms="http://www.opengis.net/wms">
+  <wms:Capability>
+    <wms:Layer>
+      <wms:Layer queryable="1">
+        <wms:Name>conus_bref_qcd</wms:Name>
+        <wms:Dimension name="time" units="ISO8601">2025-01-01T00:00:00Z,2025-01-01T00:05:00Z</wms:Dimension>
+      </wms:Layer>
+    </wms:Layer>
+  </wms:Capability>
+</wms:WMS_Capabilities>`,
+	}
+	want := "2025-01-01T00:00:00Z,2025-01-01T00:05:00Z"
+	for name, doc := range docs {
+		t.Run(name, func(t *testing.T) {
+			var caps WMSCapabilities
+			if err := xml.Unmarshal([]byte(doc), &caps); err != nil {
+				t.Fatal(err)
+			}
+			if got := caps.Capability.Layer.timeDimension("conus_bref_qcd"); got != want {
+				t.Errorf("time dimension = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestStaleTimestampsFallback(t *testing.T) {
+	useConfig(t)
+	config.UpstreamAttempts = 1
+	useLayer(t, "conus", WMSInfo{URL: failingServer(t).URL, LayerName: "conus_bref_qcd"})
+	timestamps := []string{"2025-01-01T00:00:00Z", "2025-01-01T00:05:00Z"}
+
+	// Within -stale-if-error the expired list is served, flagged as stale.
+	useCachedTimestamps(t, "conus", CacheEntry{
+		Timestamps: timestamps,
+		All:        timestamps,
+		Expiry:     time.Now().Add(-time.Minute),
+		Fetched:    time.Now().Add(-6 * time.Minute),
+	})
+	got, err := getTimestamps(context.Background(), "conus")
+	if err != nil {
+		t.Fatalf("getTimestamps with stale cache: %v", err)
+	}
+	if !slices.Equal(got, timestamps) {
+		t.Errorf("getTimestamps = %v, want %v", got, timestamps)
+	}
+	rec := httptest.NewRecorder()
+	setFramesCaching(context.Background(), rec, "conus")
+	if got, want := rec.Header().Get("Warning"), `110 - "Response is Stale"`; got != want {
+		t.Errorf("Warning = %q, want %q", got, want)
+	}
+	if got := rec.Header().Get("X-Data-Stale"); got != "true" {
+		t.Errorf("X-Data-Stale = %q, want true", got)
+	}
+	if got, want := rec.Header().Get("Cache-Control"), "max-age=10"; got != want {
+		t.Errorf("Cache-Control = %q, want %q", got, want)
+	}
+
+	// Past it, the failure is passed on.
+	useCachedTimestamps(t, "conus", CacheEntry{
+		Timestamps: timestamps,
+		All:        timestamps,
+		Expiry:     time.Now().Add(-config.StaleIfError - time.Minute),
+		Fetched:    time.Now().Add(-2 * time.Hour),
+	})
+	if got, err := getTimestamps(context.Background(), "conus"); err == nil {
+		t.Errorf("getTimestamps past -stale-if-error = %v, want error", got)
+	}
+}
+
+func TestFramesCachingFresh(t *testing.T) {
+	useCachedTimestamps(t, "conus", CacheEntry{
+		Timestamps: []string{"2025-01-01T00:00:00Z"},
+		Expiry:     time.Now().Add(time.Minute),
+		Fetched:    time.Now(),
+	})
+	rec := httptest.NewRecorder()
+	setFramesCaching(context.Background(), rec, "conus")
+	if got := rec.Header().Get("Warning"); got != "" {
+		t.Errorf("Warning = %q, want none", got)
+	}
+	if got := rec.Header().Get("X-Data-Stale"); got != "" {
+		t.Errorf("X-Data-Stale = %q, want none", got)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "max-age=59" && got != "max-age=60" {
+		t.Errorf("Cache-Control = %q, want max-age=60", got)
+	}
+}
+
+// tileCoordsStatus routes path like the tile endpoint and returns the status
+// parseTileCoords gives it, or the mux's 404 when it doesn't match.
+func tileCoordsStatus(t *testing.T, path string) int {
+	t.Helper()
+	status := http.StatusNotFound
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tiles/{z}/{x}/{file}", func(w http.ResponseWriter, r *http.Request) {
+		_, _, _, status, _ = parseTileCoords(r, tileGrids["EPSG:3857"], "@2x.png", "@2x.json", ".png", ".json")
+	})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	return status
+}
+
+func TestParseTileCoordsMalformed(t *testing.T) {
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/tiles/5/8/12.png", http.StatusOK},
+		{"/tiles/5/8/12@2x.json", http.StatusOK},
+		{"/tiles/5/-1/12.png", http.StatusOK},
+		// Wrong shapes and extensions.
+		{"/tiles/5/8", http.StatusNotFound},
+		{"/tiles/5/8/12/3.png", http.StatusNotFound},
+		{"/tiles/5/8/12", http.StatusNotFound},
+		{"/tiles/5/8/12.jpg", http.StatusNotFound},
+		{"/tiles/5/8/12.png.bak", http.StatusNotFound},
+		{"/tiles/5/8/12@3x.png", http.StatusBadRequest},
+		// Bad coordinates.
+		{"/tiles/z/8/12.png", http.StatusBadRequest},
+		{"/tiles/5/x/12.png", http.StatusBadRequest},
+		{"/tiles/5/8/y.png", http.StatusBadRequest},
+		{"/tiles/5/8/1.5.png", http.StatusBadRequest},
+		{"/tiles/-1/0/0.png", http.StatusBadRequest},
+		{"/tiles/19/0/0.png", http.StatusBadRequest},
+		{"/tiles/5/8/32.png", http.StatusBadRequest},
+		{"/tiles/5/8/-1.png", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if got := tileCoordsStatus(t, tt.path); got != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestCheckDuplicateParams(t *testing.T) {
+	tests := []struct {
+		query   string
+		wantErr bool
+	}{
+		{"", false},
+		{"area=conus&time=2025-01-01T00:00:00Z", false},
+		// Repeating a parameter with the same value is allowed.
+		{"area=conus&area=conus", false},
+		{"alerts=true&alerts=true&alerts=true", false},
+		{"area=conus&opacity=0.5&area=conus", false},
+		// Conflicting values are rejected, wherever they appear.
+		{"area=conus&area=alaska", true},
+		{"time=2025-01-01T00:00:00Z&time=now", true},
+		{"alerts=true&alerts=true&alerts=false", true},
+		{"area=conus&area=", true},
+		// Values are compared as given, not normalized.
+		{"area=conus&area=CONUS", true},
+	}
+	for _, tt := range tests {
+		query, err := url.ParseQuery(tt.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkDuplicateParams(query)
+		if tt.wantErr && err == nil {
+			t.Errorf("checkDuplicateParams(%q) = nil, want error", tt.query)
+		}
+		if !tt.wantErr && err != nil {
+			t.Errorf("checkDuplicateParams(%q) = %v", tt.query, err)
+		}
+	}
+}
+
+func TestDuplicateParamsRejected(t *testing.T) {
+	rec := httptest.NewRecorder()
+	framesHandler(rec, httptest.NewRequest(http.MethodGet, "/frames?area=conus&area=alaska", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("/frames with conflicting areas: status %d, want 400", rec.Code)
+	}
+}
+
+func TestParseBoolParam(t *testing.T) {
+	tests := []struct {
+		value   string
+		def     bool
+		want    bool
+		wantErr bool
+	}{
+		{value: "", def: false, want: false},
+		{value: "", def: true, want: true},
+		{value: "true", want: true},
+		{value: "TRUE", want: true},
+		{value: "1", want: true},
+		{value: "yes", want: true},
+		{value: "On", want: true},
+		{value: "false", def: true, want: false},
+		{value: "False", def: true, want: false},
+		{value: "0", def: true, want: false},
+		{value: "no", def: true, want: false},
+		{value: "OFF", def: true, want: false},
+		{value: "2", wantErr: true},
+		{value: "t", wantErr: true},
+		{value: "enabled", wantErr: true},
+		{value: " true", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseBoolParam(url.Values{"alerts": {tt.value}}, "alerts", tt.def)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseBoolParam(%q) = %t, want error", tt.value, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseBoolParam(%q, default %t) = %t, %v, want %t", tt.value, tt.def, got, err, tt.want)
+		}
+	}
+	if got, err := parseBoolParam(url.Values{}, "alerts", true); err != nil || !got {
+		t.Errorf("parseBoolParam without the parameter = %t, %v, want the default", got, err)
+	}
+}
+
+func TestAreaParam(t *testing.T) {
+	tests := []struct {
+		query url.Values
+		want  string
+	}{
+		{url.Values{}, "conus"},
+		{url.Values{"area": {""}}, "conus"},
+		{url.Values{"area": {"/"}}, "conus"},
+		{url.Values{"area": {"alaska"}}, "alaska"},
+		// Mixed case.
+		{url.Values{"area": {"CONUS"}}, "conus"},
+		{url.Values{"area": {"Alaska"}}, "alaska"},
+		{url.Values{"area": {"gUaM"}}, "guam"},
+		// Trailing slashes and whitespace.
+		{url.Values{"area": {"conus/"}}, "conus"},
+		{url.Values{"area": {"Hawaii//"}}, "hawaii"},
+		{url.Values{"area": {" alaska \t"}}, "alaska"},
+		{url.Values{"area": {"/conus/"}}, "conus"},
+	}
+	for _, tt := range tests {
+		if got := areaParam(tt.query); got != tt.want {
+			t.Errorf("areaParam(%q) = %q, want %q", tt.query.Get("area"), got, tt.want)
+		}
+	}
+}
+
+func TestParseTileRequestArea(t *testing.T) {
+	timestamps := []string{"2025-01-01T00:00:00Z"}
+	useCachedTimestamps(t, "conus", CacheEntry{Timestamps: timestamps, All: timestamps, Expiry: time.Now().Add(time.Hour)})
+	for _, area := range []string{"CONUS", "conus/", "Conus/"} {
+		var tile tileRequest
+		var err error
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /tiles/{z}/{x}/{file}", func(w http.ResponseWriter, r *http.Request) {
+			tile, _, err = parseTileRequest(r)
+		})
+		path := "/tiles/5/8/12.png?time=2025-01-01T00:00:00Z&area=" + url.QueryEscape(area)
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+		if err != nil || tile.Area != "conus" {
+			t.Errorf("?area=%s: area %q, %v, want conus", area, tile.Area, err)
+		}
+	}
+}
+
+func TestCapabilitiesTimeDimension(t *testing.T) {
+	data, err := os.ReadFile("testdata/capabilities_nested.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var caps WMSCapabilities
+	if err := xml.Unmarshal(data, &caps); err != nil {
+		t.Fatal(err)
+	}
+	root := caps.Capability.Layer
+	inherited := "2025-01-01T00:00:00Z,2025-01-01T00:05:00Z,2025-01-01T00:10:00Z"
+	tests := []struct {
+		name, layer, want string
+	}{
+		// Only an elevation of its own: time comes from the parent, not
+		// from the elevation sibling.
+		{"inherited", "conus_bref_qcd", inherited},
+		// Its own time dimension overrides the parent's, whatever order
+		// it comes in among the other dimensions.
+		{"own after elevation", "conus_cref_qcd", "2025-01-01T00:00:00Z/2025-01-01T00:20:00Z/PT10M"},
+		{"nested parent", "conus", inherited},
+		// No time anywhere up its tree: the first time found is used.
+		{"no time in tree", "alaska_bref_qcd", inherited},
+		{"unknown layer", "missing", inherited},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := root.timeDimension(tt.layer); got != tt.want {
+				t.Errorf("timeDimension(%q) = %q, want %q", tt.layer, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchTimestampsNestedLayer(t *testing.T) {
+	srv := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	t.Cleanup(srv.Close)
+	useLayer(t, "testarea", WMSInfo{URL: srv.URL + "/capabilities_nested.xml", LayerName: "conus_cref_qcd"})
+	t.Cleanup(func() {
+		cacheMutex.Lock()
+		delete(cache, "testarea")
+		cacheMutex.Unlock()
+	})
+
+	got, err := fetchTimestamps(context.Background(), "testarea")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"2025-01-01T00:00:00Z", "2025-01-01T00:10:00Z", "2025-01-01T00:20:00Z"}
+	if !slices.Equal(got, want) {
+		t.Errorf("fetchTimestamps = %v, want %v", got, want)
+	}
+}
+
+func TestNoContentIsEmpty(t *testing.T) {
+	useConfig(t)
+	useTileCache(t)
+	config.UpstreamAttempts = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+
+	// Without the option a 204 is an upstream failure and gets a blank.
+	useLayer(t, "testarea", WMSInfo{URL: srv.URL, LayerName: "conus_bref_qcd"})
+	tile := testTile("testarea")
+	result, _, err := tileBytes(context.Background(), tile)
+	if err != nil || !result.Negative {
+		t.Fatalf("204 without NoContentIsEmpty: negative %t, %v, want a negative blank", result.Negative, err)
+	}
+
+	// With it, the empty tile is a real one: cached like any other.
+	useLayer(t, "testarea", WMSInfo{URL: srv.URL, LayerName: "conus_bref_qcd", NoContentIsEmpty: true})
+	tile.Y++
+	tile.NoCache = false
+	result, status, err := tileBytes(context.Background(), tile)
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("tileBytes = %d, %v", status, err)
+	}
+	if result.Negative || result.Source != CACHE_MISS {
+		t.Errorf("204 tile: negative %t, source %s, want a rendered tile", result.Negative, result.Source)
+	}
+	img, err := png.Decode(bytes.NewReader(result.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != TILE_SIZE || img.Bounds().Dy() != TILE_SIZE || !fullyTransparent(img) {
+		t.Errorf("204 tile is %v and not fully transparent", img.Bounds())
+	}
+	entry, found := getCachedTile(tile.cacheKey())
+	if !found || entry.Negative {
+		t.Fatalf("204 tile cached: %t, negative %t, want a positive entry", found, entry.Negative)
+	}
+	if ttl := time.Until(entry.Expiry); ttl < config.CacheTTL-time.Second {
+		t.Errorf("204 tile cached for %v, want at least -cache-ttl", ttl)
+	}
+	if result, _, _ := tileBytes(context.Background(), tile); result.Source != CACHE_HIT_MEMORY {
+		t.Errorf("second request source = %s, want %s", result.Source, CACHE_HIT_MEMORY)
+	}
+}
+
+// tileCoordsBBox routes path like tileCoordsStatus and returns the bbox of
+// the parsed tile.
+func tileCoordsBBox(t *testing.T, path string) [4]float64 {
+	t.Helper()
+	var bbox [4]float64
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tiles/{z}/{x}/{file}", func(w http.ResponseWriter, r *http.Request) {
+		z, x, y, _, err := parseTileCoords(r, tileGrids["EPSG:3857"], ".png")
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		bbox = tileToBoundingBox(x, y, z)
+	})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	return bbox
+}
+
+func TestParseTileCoordsTMS(t *testing.T) {
+	for _, tc := range []struct{ z, x, y int }{{0, 0, 0}, {1, 1, 0}, {5, 8, 12}, {12, 1205, 1539}} {
+		flipped := 1<<tc.z - 1 - tc.y
+		xyz := tileCoordsBBox(t, fmt.Sprintf("/tiles/%d/%d/%d.png", tc.z, tc.x, flipped))
+		tms := tileCoordsBBox(t, fmt.Sprintf("/tiles/%d/%d/%d.png?scheme=tms", tc.z, tc.x, tc.y))
+		if tms != xyz {
+			t.Errorf("z%d x%d: TMS y %d gives %v, XYZ y %d gives %v", tc.z, tc.x, tc.y, tms, flipped, xyz)
+		}
+		if explicit := tileCoordsBBox(t, fmt.Sprintf("/tiles/%d/%d/%d.png?scheme=xyz", tc.z, tc.x, flipped)); explicit != xyz {
+			t.Errorf("z%d x%d: scheme=xyz gives %v, want %v", tc.z, tc.x, explicit, xyz)
+		}
+	}
+	// TMS row 0 is the southernmost.
+	if bbox := tileCoordsBBox(t, "/tiles/1/0/0.png?scheme=tms"); bbox[1] >= 0 || bbox[3] > 1 {
+		t.Errorf("TMS z1 y0 = %v, want the southern half", bbox)
+	}
+	if status := tileCoordsStatus(t, "/tiles/1/0/0.png?scheme=wmts"); status != http.StatusBadRequest {
+		t.Errorf("unknown scheme: status %d, want 400", status)
+	}
+}
+
+func TestPurgeNegativeTiles(t *testing.T) {
+	useConfig(t)
+	useTileCache(t)
+	config.NegativeTTL = time.Minute
+	blank := []byte("blank")
+	negative := func(area string, z int, key string) {
+		putNegativeTile(key, tileRequest{Area: area, Z: z}, blank)
+	}
+	negative("conus", 5, "conus/5/a")
+	negative("conus", 5, "conus/5/b")
+	negative("conus", 5, "conus/5/recovered")
+	negative("conus", 6, "conus/6/a")
+	negative("alaska", 5, "alaska/5/a")
+	// A negative entry since replaced by a real tile is left alone.
+	putCachedTile("conus/5/recovered", []byte("tile"), time.Minute)
+
+	purgeNegativeTiles("conus", 5)
+	for _, key := range []string{"conus/5/a", "conus/5/b"} {
+		if _, found := getCachedTile(key); found {
+			t.Errorf("%s still cached after purge", key)
+		}
+	}
+	for _, key := range []string{"conus/6/a", "alaska/5/a"} {
+		if entry, found := getCachedTile(key); !found || !entry.Negative {
+			t.Errorf("%s in another group: cached %t, negative %t, want kept", key, found, entry.Negative)
+		}
+	}
+	if entry, found := getCachedTile("conus/5/recovered"); !found || entry.Negative {
+		t.Errorf("replaced entry: cached %t, negative %t, want the real tile kept", found, entry.Negative)
+	}
+	tileCacheMutex.Lock()
+	_, indexed := negativeKeys["conus/5"]
+	remaining := len(negativeKeys["conus/6"]) + len(negativeKeys["alaska/5"])
+	tileCacheMutex.Unlock()
+	if indexed || remaining != 2 {
+		t.Errorf("negativeKeys after purge: conus/5 indexed %t, %d others, want false, 2", indexed, remaining)
+	}
+
+	// Purging a group with nothing negative is a no-op.
+	purgeNegativeTiles("conus", 5)
+	purgeNegativeTiles("guam", 3)
+	if _, found := getCachedTile("conus/5/recovered"); !found {
+		t.Error("empty purge dropped a real tile")
+	}
+}
+
+func TestRecoveryPurgesNegativeTiles(t *testing.T) {
+	useConfig(t)
+	useTileCache(t)
+	config.UpstreamAttempts = 1
+	config.NegativeTTL = time.Minute
+	srv, _ := emptyThenPNG(t, 1, false)
+	useLayer(t, "testarea", WMSInfo{URL: srv.URL, LayerName: "conus_bref_qcd"})
+
+	// The outage leaves a negative tile cached.
+	failed := testTile("testarea")
+	failed.NoCache = false
+	if result, _, err := tileBytes(context.Background(), failed); err != nil || !result.Negative {
+		t.Fatalf("tile during outage: negative %t, %v", result.Negative, err)
+	}
+	if entry, found := getCachedTile(failed.cacheKey()); !found || !entry.Negative {
+		t.Fatalf("negative tile cached %t, negative %t", found, entry.Negative)
+	}
+
+	// A successful render at the same area and zoom evicts it, so the next
+	// request for the failed tile goes upstream again.
+	recovered := failed
+	recovered.X++
+	if result, _, err := tileBytes(context.Background(), recovered); err != nil || result.Negative {
+		t.Fatalf("tile after recovery: negative %t, %v", result.Negative, err)
+	}
+	if _, found := getCachedTile(failed.cacheKey()); found {
+		t.Error("negative tile still cached after upstream recovered")
+	}
+	if result, _, err := tileBytes(context.Background(), failed); err != nil || result.Negative || result.Source != CACHE_MISS {
+		t.Errorf("failed tile re-requested: negative %t, source %s, %v, want a fresh render", result.Negative, result.Source, err)
+	}
+}
+
+func TestFetchWmsImageContentType(t *testing.T) {
+	useConfig(t)
+	config.UpstreamAttempts = 1
+	var tile bytes.Buffer
+	if err := png.Encode(&tile, image.NewNRGBA(image.Rect(0, 0, TILE_SIZE, TILE_SIZE))); err != nil {
+		t.Fatal(err)
+	}
+	exception := []byte(`<?xml version="1.0" encoding="UTF-8"?>
+<ServiceExceptionReport version="1.3.0" xmlns="http://www.opengis.net/ogc">
+  <ServiceException code="InvalidDimensionValue">
+    Time out of range
+  </ServiceException>
+</ServiceExceptionReport>`)
+	tests := []struct {
+		contentType string
+		body        []byte
+		wantErr     string
+	}{
+		{"image/png", tile.Bytes(), ""},
+		{"image/png; mode=8bit", tile.Bytes(), ""},
+		{"IMAGE/PNG", tile.Bytes(), ""},
+		{"Image/Png;charset=binary", tile.Bytes(), ""},
+		// Without a Content-Type the body is left to the decoder.
+		{"", tile.Bytes(), ""},
+		{"text/xml", exception, "service exception InvalidDimensionValue: Time out of range"},
+		{"application/vnd.ogc.se_xml", exception, "service exception InvalidDimensionValue: Time out of range"},
+		{"TEXT/XML; charset=utf-8", exception, "service exception InvalidDimensionValue: Time out of range"},
+		{"text/html", []byte("<html>Bad Gateway</html>"), "returned text/html instead of an image"},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if tt.contentType == "" {
+				w.Header()["Content-Type"] = nil
+			} else {
+				w.Header().Set("Content-Type", tt.contentType)
+			}
+			w.Write(tt.body)
+		}))
+		wms := WMSInfo{URL: srv.URL, LayerName: "conus_bref_qcd"}
+		img, err := fetchWmsImage(context.Background(), wms, "0,0,1,1", TILE_SIZE, TILE_SIZE, "", nil)
+		srv.Close()
+		if tt.wantErr == "" {
+			if err != nil || img == nil {
+				t.Errorf("Content-Type %q: %v, want an image", tt.contentType, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("Content-Type %q: error %v, want %q", tt.contentType, err, tt.wantErr)
+		}
+	}
+}
+
+func TestServiceException(t *testing.T) {
+	wms := WMSInfo{LayerName: "conus_bref_qcd"}
+	tests := []struct {
+		body string
+		want string
+	}{
+		{`<ServiceExceptionReport><ServiceException code="LayerNotDefined">No such layer</ServiceException></ServiceExceptionReport>`,
+			"layer conus_bref_qcd returned a service exception LayerNotDefined: No such layer"},
+		{`<ogc:ServiceExceptionReport xmlns:ogc="http://www.opengis.net/ogc"><ogc:ServiceException>Timeout</ogc:ServiceException></ogc:ServiceExceptionReport>`,
+			"layer conus_bref_qcd returned a service exception : Timeout"},
+		// Bodies that are not a report name the content type instead.
+		{`<ServiceExceptionReport/>`, "layer conus_bref_qcd returned text/xml instead of an image"},
+		{`Internal Server Error`, "layer conus_bref_qcd returned text/xml instead of an image"},
+		{``, "layer conus_bref_qcd returned text/xml instead of an image"},
+	}
+	for _, tt := range tests {
+		if got := serviceException(wms, "text/xml", []byte(tt.body)).Error(); got != tt.want {
+			t.Errorf("serviceException(%q) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestParseTileCoordsWrap(t *testing.T) {
+	tests := []struct {
+		path  string
+		wantX int
+	}{
+		{"/tiles/3/-1/2.png", 7},
+		{"/tiles/3/8/2.png", 0},
+		{"/tiles/3/-9/2.png", 7},
+		{"/tiles/0/5/0.png", 0},
+	}
+	for _, tt := range tests {
+		var x int
+		var err error
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /tiles/{z}/{x}/{file}", func(w http.ResponseWriter, r *http.Request) {
+			_, x, _, _, err = parseTileCoords(r, tileGrids["EPSG:3857"], ".png")
+		})
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if err != nil || x != tt.wantX {
+			t.Errorf("%s: column %d, %v, want %d", tt.path, x, err, tt.wantX)
+		}
+	}
+}
+
+// tileRequestFor parses the tile request for path like the tile route.
+func tileRequestFor(t *testing.T, path string) (tileRequest, int, error) {
+	t.Helper()
+	var tile tileRequest
+	var status int
+	var err error
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tiles/{z}/{x}/{file}", func(w http.ResponseWriter, r *http.Request) {
+		tile, status, err = parseTileRequest(r)
+	})
+	mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	return tile, status, err
+}
+
+func TestConfiguredElevations(t *testing.T) {
+	useConfig(t)
+	useTileCache(t)
+	config.UpstreamAttempts = 1
+	savedLayers, savedHazards := maps.Clone(radarLayers), hazardsLayer
+	t.Cleanup(func() { radarLayers, hazardsLayer = savedLayers, savedHazards })
+	var elevation atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		elevation.Store(r.URL.Query().Get("ELEVATION"))
+		w.Header().Set("Content-Type", "image/png")
+		png.Encode(w, image.NewNRGBA(image.Rect(0, 0, TILE_SIZE, TILE_SIZE)))
+	}))
+	t.Cleanup(srv.Close)
+
+	path := t.TempDir() + "/layers.json"
+	layers := `{"layers": {"ktlx": {"url": "` + srv.URL + `", "layerName": "ktlx_sr_bref", "elevations": ["0.5", "0.9", "1.3", "1.8"]}}}`
+	if err := os.WriteFile(path, []byte(layers), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadLayerConfig(path); err != nil {
+		t.Fatal(err)
+	}
+	timestamps := []string{"2025-01-01T00:00:00Z"}
+	for _, area := range []string{"ktlx", "conus"} {
+		useCachedTimestamps(t, area, CacheEntry{Timestamps: timestamps, All: timestamps, Expiry: time.Now().Add(time.Hour)})
+	}
+
+	tile, status, err := tileRequestFor(t, "/tiles/5/7/12.png?area=ktlx&elevation=0.9")
+	if err != nil {
+		t.Fatalf("configured elevation: %d %v", status, err)
+	}
+	if _, _, err := tileBytes(context.Background(), tile); err != nil {
+		t.Fatal(err)
+	}
+	if got := elevation.Load(); got != "0.9" {
+		t.Errorf("GetMap ELEVATION = %v, want 0.9", got)
+	}
+
+	for _, path := range []string{
+		"/tiles/5/7/12.png?area=ktlx&elevation=2.4",
+		"/tiles/5/7/12.png?area=conus&elevation=0.5",
+	} {
+		if _, status, err := tileRequestFor(t, path); err == nil || status != http.StatusBadRequest {
+			t.Errorf("%s: status %d, %v, want 400", path, status, err)
+		}
+	}
+}
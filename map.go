@@ -0,0 +1,309 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// --- Arbitrary Extent Maps ---
+
+const MAX_MAP_SIZE = 2048
+
+// MAX_BBOX_LONGITUDE bounds the longitudes of a requested bbox. Views may
+// cross the antimeridian into the MAX_WRAPPED_WORLDS copies of the world
+// shown past each edge, but no further.
+const MAX_BBOX_LONGITUDE = 180 + 360*MAX_WRAPPED_WORLDS
+
+// parseLonLatBBox parses a "west,south,east,north" bbox in degrees.
+// Coordinates must be finite, longitudes within MAX_BBOX_LONGITUDE and
+// latitudes within the Web Mercator range.
+func parseLonLatBBox(s string) ([4]float64, error) {
+	var b [4]float64
+	fields := strings.Split(s, ",")
+	if len(fields) != 4 {
+		return b, fmt.Errorf("bbox must be west,south,east,north")
+	}
+	for i, f := range fields {
+		v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return b, fmt.Errorf("invalid bbox coordinate %q", f)
+		}
+		b[i] = v
+	}
+	if b[0] >= b[2] || b[1] >= b[3] {
+		return b, fmt.Errorf("bbox must have west < east and south < north")
+	}
+	if b[0] < -MAX_BBOX_LONGITUDE || b[2] > MAX_BBOX_LONGITUDE {
+		return b, fmt.Errorf("bbox longitude must be within ±%d", MAX_BBOX_LONGITUDE)
+	}
+	if b[1] < -85.0511 || b[3] > 85.0511 {
+		return b, fmt.Errorf("bbox latitude must be within the Web Mercator range")
+	}
+	return b, nil
+}
+
+// parseDimension parses an image dimension, clamping it to [1, MAX_MAP_SIZE].
+func parseDimension(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid dimension %q", s)
+	}
+	return max(1, min(v, MAX_MAP_SIZE)), nil
+}
+
+// fitBoundingBox projects a degree bbox to Web Mercator and widens its
+// shorter side around the center so it matches the width:height aspect
+// ratio, which keeps the upstream image from being stretched. The result is
+// minX, minY, maxX, maxY in meters.
+func fitBoundingBox(b [4]float64, width, height int) [4]float64 {
+	minX, minY := lonLatToMercator(b[0], b[1])
+	maxX, maxY := lonLatToMercator(b[2], b[3])
+
+	aspect := float64(width) / float64(height)
+	spanX, spanY := maxX-minX, maxY-minY
+	if spanX/spanY < aspect {
+		grow := (spanY*aspect - spanX) / 2
+		minX, maxX = minX-grow, maxX+grow
+	} else {
+		grow := (spanX/aspect - spanY) / 2
+		minY, maxY = minY-grow, maxY+grow
+	}
+	return [4]float64{minX, minY, maxX, maxY}
+}
+
+// mapHandler renders an image of any size for a geographic extent, for
+// displays that don't fit the square tile grid.
+func mapHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if err := checkDuplicateParams(query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	area := areaParam(query)
+	radarInfo, ok := radarLayers[area]
+	if !ok {
+		http.Error(w, "invalid area: "+area, http.StatusBadRequest)
+		return
+	}
+
+	extent, err := parseLonLatBBox(query.Get("bbox"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Thermal mode prints 1-bit PNGs at printer width.
+	mode := query.Get("mode")
+	if mode != "" && mode != "thermal" {
+		http.Error(w, "invalid mode: "+mode, http.StatusBadRequest)
+		return
+	}
+	thermal, defaultWidth, formats := mode == "thermal", TILE_SIZE, mapFormats
+	if thermal {
+		defaultWidth, formats = THERMAL_WIDTH, []string{"png"}
+	}
+	width, err := parseDimension(query.Get("width"), defaultWidth)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	height, err := parseDimension(query.Get("height"), TILE_SIZE)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format, err := parseFormat(query, formats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	metadata, err := parseMetadata(query, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	legend, err := parseLegend(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	showAlerts, err := alertsRequested(query, area)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	scaleBar, err := parseBoolParam(query, "scalebar", false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	label, err := parseBoolParam(query, "label", false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timestamp := query.Get("time")
+	if timestamp == "" {
+		timestamps, err := getTimestamps(r.Context(), area)
+		if err != nil || len(timestamps) == 0 {
+			http.Error(w, "Could not get latest timestamp", http.StatusInternalServerError)
+			return
+		}
+		timestamp = timestamps[len(timestamps)-1]
+	}
+
+	m := fitBoundingBox(extent, width, height)
+	img, _, err := fetchRadarMap(r.Context(), radarInfo, m, width, height, timestamp, nil, nil, showAlerts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if thermal {
+		img = ditherThermal(img)
+	}
+	if scaleBar {
+		img = drawScaleBar(img, groundResolution(m, width))
+	}
+	if label {
+		img = drawTimestampLabel(img, timestamp, radarInfo.location())
+	}
+	img = drawLegend(img, legend)
+	if thermal {
+		img = thresholdMono(img)
+	}
+
+	w.Header().Set("Content-Type", contentType(format))
+	if metadata {
+		encodeJPEGWithMetadata(w, img, timestamp, lonLatBounds(m))
+		return
+	}
+	encodeImage(w, img, format)
+}
+
+// --- Point of Interest Views ---
+
+// MAX_POI_RADIUS_KM bounds the radius of a point-of-interest view.
+const MAX_POI_RADIUS_KM = 2000
+
+// poiBoundingBox returns the Web Mercator extent of a size-pixel square
+// centred on lon, lat at the deepest zoom level whose view still covers
+// radiusKm in every direction, along with that zoom.
+func poiBoundingBox(lon, lat, radiusKm float64, size int) ([4]float64, int) {
+	// Ground resolution at zoom z is this circumference / (TILE_SIZE * 2^z).
+	circumference := 2 * math.Pi * EARTH_RADIUS * math.Cos(lat*math.Pi/180)
+	fit := circumference * float64(size) / (TILE_SIZE * 2 * radiusKm * 1000)
+	zoom := max(0, min(int(math.Floor(math.Log2(fit))), 18))
+
+	half := float64(size) / 2 * 2 * math.Pi * EARTH_RADIUS / (TILE_SIZE * math.Exp2(float64(zoom)))
+	x, y := lonLatToMercator(lon, lat)
+	return [4]float64{x - half, y - half, x + half, y + half}, zoom
+}
+
+// poiHandler renders a square image centred on a point covering a radius
+// around it, for location-centric clients that don't want to work with
+// tiles. The chosen zoom is reported in X-Zoom.
+func poiHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if err := checkDuplicateParams(query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	area := areaParam(query)
+	radarInfo, ok := radarLayers[area]
+	if !ok {
+		http.Error(w, "invalid area: "+area, http.StatusBadRequest)
+		return
+	}
+
+	lat, err := strconv.ParseFloat(query.Get("lat"), 64)
+	if err != nil || math.IsNaN(lat) || math.IsInf(lat, 0) || lat < -85.0511 || lat > 85.0511 {
+		http.Error(w, "lat must be a latitude within the Web Mercator range", http.StatusBadRequest)
+		return
+	}
+	lon, err := strconv.ParseFloat(query.Get("lon"), 64)
+	if err != nil || math.IsNaN(lon) || math.IsInf(lon, 0) || lon < -180 || lon > 180 {
+		http.Error(w, "lon must be a longitude in [-180, 180]", http.StatusBadRequest)
+		return
+	}
+	radiusKm := 50.0
+	if v := query.Get("radiusKm"); v != "" {
+		if radiusKm, err = strconv.ParseFloat(v, 64); err != nil || !(radiusKm > 0 && radiusKm <= MAX_POI_RADIUS_KM) {
+			http.Error(w, fmt.Sprintf("radiusKm must be in (0, %d]", MAX_POI_RADIUS_KM), http.StatusBadRequest)
+			return
+		}
+	}
+	size, err := parseDimension(query.Get("size"), 2*TILE_SIZE)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format, err := parseFormat(query, mapFormats)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	metadata, err := parseMetadata(query, format)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	legend, err := parseLegend(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	showAlerts, err := alertsRequested(query, area)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timestamp := query.Get("time")
+	if timestamp == "" {
+		timestamps, err := getTimestamps(r.Context(), area)
+		if err != nil || len(timestamps) == 0 {
+			http.Error(w, "Could not get latest timestamp", http.StatusInternalServerError)
+			return
+		}
+		timestamp = timestamps[len(timestamps)-1]
+	}
+
+	m, zoom := poiBoundingBox(lon, lat, radiusKm, size)
+	img, _, err := fetchRadarMap(r.Context(), radarInfo, m, size, size, timestamp, nil, nil, showAlerts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	img = drawLegend(img, legend)
+
+	w.Header().Set("X-Zoom", strconv.Itoa(zoom))
+	w.Header().Set("X-Radar-Timestamp", timestamp)
+	w.Header().Set("Content-Type", contentType(format))
+	if metadata {
+		encodeJPEGWithMetadata(w, img, timestamp, lonLatBounds(m))
+		return
+	}
+	encodeImage(w, img, format)
+}
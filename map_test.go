@@ -0,0 +1,129 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseLonLatBBox(t *testing.T) {
+	tests := []struct {
+		bbox    string
+		want    [4]float64
+		wantErr bool
+	}{
+		{bbox: "-100,30,-90,40", want: [4]float64{-100, 30, -90, 40}},
+		{bbox: " -100 , 30 , -90 , 40 ", want: [4]float64{-100, 30, -90, 40}},
+		{bbox: "-180,-85.0511,180,85.0511", want: [4]float64{-180, -85.0511, 180, 85.0511}},
+		// Views across the antimeridian, within one world past the edge.
+		{bbox: "140,10,200,25", want: [4]float64{140, 10, 200, 25}},
+		{bbox: "-200,50,-150,60", want: [4]float64{-200, 50, -150, 60}},
+		{bbox: "-540,0,540,10", want: [4]float64{-540, 0, 540, 10}},
+		// Non-finite coordinates.
+		{bbox: "NaN,30,-90,40", wantErr: true},
+		{bbox: "-100,NaN,-90,40", wantErr: true},
+		{bbox: "NaN,NaN,NaN,NaN", wantErr: true},
+		{bbox: "-Inf,30,-90,40", wantErr: true},
+		{bbox: "-100,30,+Inf,40", wantErr: true},
+		{bbox: "-infinity,0,infinity,10", wantErr: true},
+		{bbox: "-100,-Inf,-90,Inf", wantErr: true},
+		// Longitudes beyond one world past the edge.
+		{bbox: "-1e7,0,1e7,10", wantErr: true},
+		{bbox: "-541,0,-500,10", wantErr: true},
+		{bbox: "500,0,541,10", wantErr: true},
+		{bbox: "-1e308,0,0,10", wantErr: true},
+		// Latitudes outside Web Mercator, reversed and malformed boxes.
+		{bbox: "-100,-86,-90,40", wantErr: true},
+		{bbox: "-100,30,-90,90", wantErr: true},
+		{bbox: "-90,30,-100,40", wantErr: true},
+		{bbox: "-100,40,-90,30", wantErr: true},
+		{bbox: "-100,30,-100,40", wantErr: true},
+		{bbox: "-100,30,-90", wantErr: true},
+		{bbox: "-100,30,-90,40,0", wantErr: true},
+		{bbox: "", wantErr: true},
+		{bbox: "west,30,-90,40", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseLonLatBBox(tt.bbox)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseLonLatBBox(%q) = %v, want error", tt.bbox, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseLonLatBBox(%q) = %v, %v, want %v", tt.bbox, got, err, tt.want)
+		}
+	}
+}
+
+func TestInvalidBBoxRejected(t *testing.T) {
+	for _, bbox := range []string{"NaN,NaN,NaN,NaN", "-1e7,0,1e7,10", "-Inf,0,Inf,10"} {
+		for _, endpoint := range []struct {
+			path    string
+			handler http.HandlerFunc
+		}{{"/map", mapHandler}, {"/card", cardHandler}} {
+			rec := httptest.NewRecorder()
+			endpoint.handler(rec, httptest.NewRequest(http.MethodGet, endpoint.path+"?bbox="+url.QueryEscape(bbox), nil))
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "bbox") {
+				t.Errorf("%s?bbox=%s: status %d %q, want a 400 for the bbox", endpoint.path, bbox, rec.Code, rec.Body.String())
+			}
+		}
+	}
+}
+
+func TestPregenerateBBoxRejected(t *testing.T) {
+	useConfig(t)
+	config.PregenerateArea = "conus"
+	for _, bbox := range []string{"NaN,NaN,NaN,NaN", "-1e7,0,1e7,10"} {
+		config.PregenerateBBox = bbox
+		if set, err := planTileSet(); err == nil {
+			t.Errorf("-pregenerate-bbox %s: planned %v, want error", bbox, set.Extent)
+		}
+	}
+}
+
+func TestPOICoordinates(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"lat=NaN&lon=-97", "lat must be"},
+		{"lat=nan&lon=-97", "lat must be"},
+		{"lat=35&lon=NaN", "lon must be"},
+		{"lat=NaN&lon=NaN", "lat must be"},
+		{"lat=Inf&lon=-97", "lat must be"},
+		{"lat=-Inf&lon=-97", "lat must be"},
+		{"lat=35&lon=+Inf", "lon must be"},
+		{"lat=35&lon=-infinity", "lon must be"},
+		{"lat=86&lon=-97", "lat must be"},
+		{"lat=35&lon=181", "lon must be"},
+		{"lat=35&lon=-97&radiusKm=NaN", "radiusKm must be"},
+		{"lat=35&lon=-97&radiusKm=Inf", "radiusKm must be"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		poiHandler(rec, httptest.NewRequest(http.MethodGet, "/poi?"+tt.query, nil))
+		if rec.Code != http.StatusBadRequest || !strings.HasPrefix(rec.Body.String(), tt.want) {
+			t.Errorf("/poi?%s: status %d %q, want 400 %q", tt.query, rec.Code, rec.Body.String(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+)
+
+// --- GeoJSON Clip Masks ---
+
+// ring is a closed polygon ring of [lon, lat] positions.
+type ring [][2]float64
+
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Coordinates json.RawMessage `json:"coordinates"`
+	Geometry    *geoJSON        `json:"geometry"`
+	Features    []geoJSON       `json:"features"`
+}
+
+// rings flattens the polygons of a GeoJSON object into their rings. Holes
+// come out as ordinary rings; even-odd filling cuts them back out.
+func (g *geoJSON) rings() ([]ring, error) {
+	switch g.Type {
+	case "FeatureCollection":
+		var all []ring
+		for i := range g.Features {
+			r, err := g.Features[i].rings()
+			if err != nil {
+				return nil, err
+			}
+			all = append(all, r...)
+		}
+		return all, nil
+	case "Feature":
+		if g.Geometry == nil {
+			return nil, nil
+		}
+		return g.Geometry.rings()
+	case "Polygon":
+		var rings []ring
+		err := json.Unmarshal(g.Coordinates, &rings)
+		return rings, err
+	case "MultiPolygon":
+		var polygons [][]ring
+		if err := json.Unmarshal(g.Coordinates, &polygons); err != nil {
+			return nil, err
+		}
+		return slices.Concat(polygons...), nil
+	}
+	return nil, fmt.Errorf("unsupported GeoJSON type %q", g.Type)
+}
+
+var maskNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// validMaskName reports whether name is safe to resolve inside MaskDir.
+func validMaskName(name string) bool {
+	return config.MaskDir != "" && maskNamePattern.MatchString(name)
+}
+
+// MAX_MASK_RASTERS caps the rasterized masks kept in memory. Any client can
+// ask for a mask at every z/x/y, so they are evicted least recently used.
+const MAX_MASK_RASTERS = 1024
+
+// maskRaster is a rasterized mask held in maskLRU.
+type maskRaster struct {
+	Key  string
+	Mask *image.Alpha
+}
+
+// maskPolygons caches parsed masks by name. maskRasters indexes the elements
+// of maskLRU, which orders the rasterized tiles from most to least recently
+// used.
+var (
+	maskPolygons   = make(map[string][]ring)
+	maskRasters    = make(map[string]*list.Element)
+	maskLRU        = list.New()
+	maskCacheMutex = &sync.Mutex{}
+)
+
+// loadMask reads and parses a mask's polygons, caching them by name.
+func loadMask(name string) ([]ring, error) {
+	maskCacheMutex.Lock()
+	rings, found := maskPolygons[name]
+	maskCacheMutex.Unlock()
+	if found {
+		return rings, nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(config.MaskDir, name+".geojson"))
+	if err != nil {
+		return nil, err
+	}
+	var doc geoJSON
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if rings, err = doc.rings(); err != nil {
+		return nil, err
+	}
+
+	maskCacheMutex.Lock()
+	maskPolygons[name] = rings
+	maskCacheMutex.Unlock()
+	return rings, nil
+}
+
+// tileMask returns the named mask rasterized for a size pixel tile, caching
+// the result per mask, z/x/y and size since the geometry never changes
+// between frames.
+func tileMask(name string, x, y, zoom, size int) (*image.Alpha, error) {
+	key := fmt.Sprintf("%s/%d/%d/%d@%d", name, zoom, x, y, size)
+	maskCacheMutex.Lock()
+	el, found := maskRasters[key]
+	if found {
+		maskLRU.MoveToFront(el)
+	}
+	maskCacheMutex.Unlock()
+	if found {
+		return el.Value.(*maskRaster).Mask, nil
+	}
+
+	rings, err := loadMask(name)
+	if err != nil {
+		return nil, err
+	}
+	minX, _, maxX, maxY := tileBounds(x, y, zoom)
+	mask := rasterizeRings(rings, minX, maxY, (maxX-minX)/float64(size), size, size)
+
+	maskCacheMutex.Lock()
+	defer maskCacheMutex.Unlock()
+	if _, found := maskRasters[key]; !found {
+		maskRasters[key] = maskLRU.PushFront(&maskRaster{Key: key, Mask: mask})
+	}
+	for maskLRU.Len() > MAX_MASK_RASTERS {
+		oldest := maskLRU.Back()
+		maskLRU.Remove(oldest)
+		delete(maskRasters, oldest.Value.(*maskRaster).Key)
+	}
+	return mask, nil
+}
+
+// rasterizeRings fills rings into a width x height alpha mask using the
+// even-odd rule, sampling at pixel centers. originX/originY is the Web
+// Mercator position of the top-left corner and resolution the meters per
+// pixel.
+func rasterizeRings(rings []ring, originX, originY, resolution float64, width, height int) *image.Alpha {
+	// Project every vertex into pixel space once up front.
+	projected := make([][][2]float64, len(rings))
+	for i, r := range rings {
+		projected[i] = make([][2]float64, len(r))
+		for j, pos := range r {
+			mx, my := lonLatToMercator(pos[0], pos[1])
+			projected[i][j] = [2]float64{(mx - originX) / resolution, (originY - my) / resolution}
+		}
+	}
+
+	mask := image.NewAlpha(image.Rect(0, 0, width, height))
+	var crossings []float64
+	for row := 0; row < height; row++ {
+		cy := float64(row) + 0.5
+		crossings = crossings[:0]
+		for _, r := range projected {
+			for i := range r {
+				a, b := r[i], r[(i+1)%len(r)]
+				if (a[1] <= cy) != (b[1] <= cy) {
+					crossings = append(crossings, a[0]+(cy-a[1])/(b[1]-a[1])*(b[0]-a[0]))
+				}
+			}
+		}
+		slices.Sort(crossings)
+		for i := 0; i+1 < len(crossings); i += 2 {
+			start := max(0, int(math.Ceil(crossings[i]-0.5)))
+			end := min(width, int(math.Ceil(crossings[i+1]-0.5)))
+			for col := start; col < end; col++ {
+				mask.SetAlpha(col, row, color.Alpha{A: 0xff})
+			}
+		}
+	}
+	return mask
+}
+
+// applyMask makes every pixel of img outside the mask transparent.
+func applyMask(img image.Image, mask *image.Alpha) image.Image {
+	clipped := image.NewRGBA(img.Bounds())
+	draw.DrawMask(clipped, clipped.Bounds(), img, img.Bounds().Min, mask, image.Point{}, draw.Src)
+	return clipped
+}
@@ -0,0 +1,108 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	_ "modernc.org/sqlite"
+)
+
+// --- MBTiles Export ---
+
+const MBTILES_SCHEMA = `
+CREATE TABLE metadata (name TEXT, value TEXT);
+CREATE TABLE tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB);
+CREATE UNIQUE INDEX tile_index ON tiles (zoom_level, tile_column, tile_row);
+`
+
+// exportMBTiles renders the latest frame of the -pregenerate-* tile set into
+// a new MBTiles file at path. The file is removed if the export fails.
+func exportMBTiles(path string) (err error) {
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists", path)
+	}
+	set, err := planTileSet()
+	if err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := db.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+	if _, err := db.Exec(MBTILES_SCHEMA); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for name, value := range mbtilesMetadata(set) {
+		if _, err := tx.Exec("INSERT INTO metadata (name, value) VALUES (?, ?)", name, value); err != nil {
+			return err
+		}
+	}
+	insert, err := tx.Prepare("INSERT INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+
+	// MBTiles rows follow TMS, counting up from the south.
+	err = renderTileSet(context.Background(), set, func(tile tileRequest, data []byte) error {
+		_, err := insert.Exec(tile.Z, tile.X, (1<<tile.Z)-1-tile.Y, data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Exported %d tiles to %s", len(set.Tiles), path)
+	return nil
+}
+
+// mbtilesMetadata returns the metadata table rows describing set.
+func mbtilesMetadata(set tileSet) map[string]string {
+	return map[string]string{
+		"name":        "radar " + set.Area,
+		"description": "Radar for " + set.Area + " at " + set.Time,
+		"type":        "overlay",
+		"version":     "1",
+		"format":      "png",
+		"bounds":      fmt.Sprintf("%g,%g,%g,%g", set.Extent[0], set.Extent[1], set.Extent[2], set.Extent[3]),
+		"minzoom":     strconv.Itoa(set.MinZoom),
+		"maxzoom":     strconv.Itoa(set.MaxZoom),
+	}
+}
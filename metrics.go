@@ -0,0 +1,148 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// --- Metrics ---
+
+// metrics holds process-wide counters. They are served as JSON on the
+// /admin/vars endpoint.
+var metrics struct {
+	requests       atomic.Int64
+	cacheHits      atomic.Int64
+	cacheMisses    atomic.Int64
+	upstreamErrors atomic.Int64
+	bytesOut       atomic.Int64
+	inFlight       atomic.Int64
+	degraded       atomic.Int64
+}
+
+var startTime = time.Now()
+
+// varsHandler serves a snapshot of the process-wide counters. It is an admin
+// endpoint, unlike expvar's /debug/vars, which would also publish the command
+// line and with it any secrets passed as flags.
+func varsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"requests":       metrics.requests.Load(),
+		"cacheHits":      metrics.cacheHits.Load(),
+		"cacheMisses":    metrics.cacheMisses.Load(),
+		"upstreamErrors": metrics.upstreamErrors.Load(),
+		"bytesOut":       metrics.bytesOut.Load(),
+		"inFlight":       metrics.inFlight.Load(),
+		"degraded":       metrics.degraded.Load(),
+		"uptimeSeconds":  int64(time.Since(startTime).Seconds()),
+	})
+}
+
+// countingWriter tallies the body bytes written to a response.
+type countingWriter struct {
+	http.ResponseWriter
+}
+
+func (cw countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.ResponseWriter.Write(p)
+	metrics.bytesOut.Add(int64(n))
+	return n, err
+}
+
+func (cw countingWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// countTraffic counts every request, the requests in flight and the bytes
+// sent in reply.
+func countTraffic(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		metrics.requests.Add(1)
+		metrics.inFlight.Add(1)
+		defer metrics.inFlight.Add(-1)
+		next.ServeHTTP(countingWriter{w}, r)
+	})
+}
+
+// overloaded reports whether enough requests are in flight that tiles
+// should take the cheaper degraded rendering path.
+func overloaded() bool {
+	return config.DegradeInFlight > 0 && metrics.inFlight.Load() > int64(config.DegradeInFlight)
+}
+
+// --- Prometheus ---
+
+// Prometheus metrics, served on /metrics. Unlike the /admin/vars counters they
+// are labeled, and are recorded where the labels are known.
+var (
+	promTimestampCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wmsproxy_timestamp_cache_requests_total",
+		Help: "Timestamp cache lookups by area and result (hit or miss).",
+	}, []string{"area", "result"})
+	promTileCache = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wmsproxy_tile_cache_requests_total",
+		Help: "Tile cache lookups by area and result (hit or miss).",
+	}, []string{"area", "result"})
+	promUpstreamRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wmsproxy_upstream_requests_total",
+		Help: "Upstream WMS requests by area, request type and outcome (ok or error).",
+	}, []string{"area", "request", "outcome"})
+	promUpstreamDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wmsproxy_upstream_request_duration_seconds",
+		Help:    "Latency of upstream GetMap requests by area.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"area"})
+	promTilesServed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wmsproxy_tiles_served_total",
+		Help: "Tiles served by zoom level.",
+	}, []string{"zoom"})
+)
+
+// layerArea returns the area a layer is configured for, as a metric label.
+func layerArea(wms WMSInfo) string {
+	if wms.URL == hazardsLayer.URL && wms.LayerName == hazardsLayer.LayerName {
+		return "hazards"
+	}
+	for area, layer := range radarLayers {
+		if layer.URL == wms.URL && layer.LayerName == wms.LayerName {
+			return area
+		}
+	}
+	return "unknown"
+}
+
+// recordUpstreamRequest counts an upstream request to area by outcome.
+func recordUpstreamRequest(area, request string, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	promUpstreamRequests.WithLabelValues(area, request, outcome).Inc()
+}
+
+// recordTileServed counts a tile served at zoom.
+func recordTileServed(zoom int) {
+	promTilesServed.WithLabelValues(strconv.Itoa(zoom)).Inc()
+}
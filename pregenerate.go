@@ -0,0 +1,177 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// --- Tile Pregeneration ---
+
+// parseZoomRange parses a "min-max" (or single "z") zoom range.
+func parseZoomRange(s string) (int, int, error) {
+	lo, hi, found := strings.Cut(s, "-")
+	if !found {
+		hi = lo
+	}
+	minZoom, err1 := strconv.Atoi(lo)
+	maxZoom, err2 := strconv.Atoi(hi)
+	if err1 != nil || err2 != nil || minZoom < 0 || maxZoom < minZoom || maxZoom > MAX_ZOOM {
+		return 0, 0, fmt.Errorf("invalid zoom range %q", s)
+	}
+	return minZoom, maxZoom, nil
+}
+
+// plainTile returns the tile request a client sends with no options.
+func plainTile(area string, z, x, y int) tileRequest {
+	return tileRequest{Area: area, Z: z, X: x, Y: y, Opacity: 1, Contrast: 1, Scale: 1, Format: "png"}
+}
+
+// tilesInExtent lists every tile covering a degree extent over a zoom range.
+func tilesInExtent(area string, extent [4]float64, minZoom, maxZoom int) []tileRequest {
+	var tiles []tileRequest
+	for z := minZoom; z <= maxZoom; z++ {
+		minX, minY := lonLatToTile(extent[0], extent[3], z)
+		maxX, maxY := lonLatToTile(extent[2], extent[1], z)
+		for x := minX; x <= maxX; x++ {
+			for y := minY; y <= maxY; y++ {
+				tiles = append(tiles, plainTile(area, z, x, y))
+			}
+		}
+	}
+	return tiles
+}
+
+// tileSet is the area, extent, zoom range and frame selected by the
+// -pregenerate-* flags.
+type tileSet struct {
+	Area             string
+	Extent           [4]float64
+	MinZoom, MaxZoom int
+	Time             string
+	Tiles            []tileRequest
+}
+
+// planTileSet resolves the -pregenerate-* flags into the tiles of the latest
+// frame.
+func planTileSet() (tileSet, error) {
+	set := tileSet{Area: config.PregenerateArea}
+	wmsInfo, ok := radarLayers[set.Area]
+	if !ok {
+		return set, fmt.Errorf("invalid area: %s", set.Area)
+	}
+	var err error
+	if set.MinZoom, set.MaxZoom, err = parseZoomRange(config.PregenerateZooms); err != nil {
+		return set, err
+	}
+	set.Extent = wmsInfo.Extent
+	if config.PregenerateBBox != "" {
+		if set.Extent, err = parseLonLatBBox(config.PregenerateBBox); err != nil {
+			return set, err
+		}
+	}
+
+	timestamps, err := getTimestamps(context.Background(), set.Area)
+	if err != nil || len(timestamps) == 0 {
+		return set, fmt.Errorf("could not get latest timestamp: %v", err)
+	}
+	set.Time = timestamps[len(timestamps)-1]
+	set.Tiles = tilesInExtent(set.Area, set.Extent, set.MinZoom, set.MaxZoom)
+	return set, nil
+}
+
+// renderTileSet renders every tile in set with -pregenerate-workers
+// concurrent fetches and hands each to write, which must be safe for
+// concurrent use. Blank tiles from upstream failures count as failures.
+func renderTileSet(ctx context.Context, set tileSet, write func(tile tileRequest, data []byte) error) error {
+	log.Printf("Rendering %d tiles for '%s' at %s", len(set.Tiles), set.Area, set.Time)
+
+	var done, failed atomic.Int64
+	jobs := make(chan tileRequest)
+	var wg sync.WaitGroup
+	for range max(1, config.PregenerateWorkers) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tile := range jobs {
+				tile.Time = set.Time
+				if err := renderTileTo(ctx, tile, write); err != nil {
+					failed.Add(1)
+					log.Printf("Tile %d/%d/%d failed: %v", tile.Z, tile.X, tile.Y, err)
+				}
+				if n := done.Add(1); n%100 == 0 || int(n) == len(set.Tiles) {
+					log.Printf("Rendered %d/%d tiles", n, len(set.Tiles))
+				}
+			}
+		}()
+	}
+	for _, tile := range set.Tiles {
+		if ctx.Err() != nil {
+			break
+		}
+		jobs <- tile
+	}
+	close(jobs)
+	wg.Wait()
+
+	if n := failed.Load(); n > 0 {
+		return fmt.Errorf("%d of %d tiles failed", n, len(set.Tiles))
+	}
+	return nil
+}
+
+func renderTileTo(ctx context.Context, tile tileRequest, write func(tile tileRequest, data []byte) error) error {
+	result, _, err := tileBytes(ctx, tile)
+	if err != nil {
+		return err
+	}
+	if result.Negative {
+		return fmt.Errorf("upstream failed; not writing blank tile")
+	}
+	if result.Partial {
+		return fmt.Errorf("alerts upstream failed; not writing tile without alerts")
+	}
+	return write(tile, result.Data)
+}
+
+// pregenerate renders the latest frame of every tile in the configured area
+// and zoom range into PregenerateDir as {area}/{z}/{x}/{y}.png, for seeding a
+// CDN or edge cache.
+func pregenerate() error {
+	set, err := planTileSet()
+	if err != nil {
+		return err
+	}
+	return renderTileSet(context.Background(), set, writeTile)
+}
+
+// writeTile writes a rendered tile under PregenerateDir.
+func writeTile(tile tileRequest, data []byte) error {
+	path := filepath.Join(config.PregenerateDir, tile.Area, strconv.Itoa(tile.Z), strconv.Itoa(tile.X), strconv.Itoa(tile.Y)+".png")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
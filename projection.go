@@ -0,0 +1,225 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// --- Projections ---
+
+const EARTH_RADIUS = 6378137.0
+
+// MERCATOR_EXTENT is the half-width of the EPSG:3857 world in meters.
+const MERCATOR_EXTENT = math.Pi * EARTH_RADIUS
+
+// supportedCRS lists the projections we can compute GetMap bboxes for.
+var supportedCRS = map[string]bool{
+	"EPSG:3857": true,
+	"EPSG:4326": true,
+}
+
+// supportedVersions lists the WMS versions we can speak to upstreams.
+var supportedVersions = map[string]bool{
+	"1.1.1": true,
+	"1.3.0": true,
+}
+
+// lonLatToMercator projects WGS84 degrees to EPSG:3857 meters.
+func lonLatToMercator(lon, lat float64) (float64, float64) {
+	x := EARTH_RADIUS * lon * math.Pi / 180
+	y := EARTH_RADIUS * math.Log(math.Tan(math.Pi/4+lat*math.Pi/360))
+	return x, y
+}
+
+// mercatorToLonLat converts EPSG:3857 meters back to WGS84 degrees.
+func mercatorToLonLat(x, y float64) (float64, float64) {
+	lon := x / EARTH_RADIUS * 180 / math.Pi
+	lat := (2*math.Atan(math.Exp(y/EARTH_RADIUS)) - math.Pi/2) * 180 / math.Pi
+	return lon, lat
+}
+
+// lonLatBounds converts an EPSG:3857 extent to west, south, east, north
+// degrees.
+func lonLatBounds(m [4]float64) [4]float64 {
+	west, south := mercatorToLonLat(m[0], m[1])
+	east, north := mercatorToLonLat(m[2], m[3])
+	return [4]float64{west, south, east, north}
+}
+
+// MAX_ZOOM is the deepest zoom level tiles are served at.
+const MAX_ZOOM = 18
+
+// clampMercator limits an extent to the valid EPSG:3857 world.
+func clampMercator(b [4]float64) [4]float64 {
+	for i, v := range b {
+		b[i] = max(-MERCATOR_EXTENT, min(v, MERCATOR_EXTENT))
+	}
+	return b
+}
+
+// tileGrid is a tiling scheme tiles can be addressed in. Every grid is one
+// tile tall at zoom 0 and doubles each way per zoom level.
+type tileGrid struct {
+	// Columns is how many tiles wide the grid is at zoom 0.
+	Columns int
+	// bbox returns how each layer is asked for a tile pixels wide.
+	bbox func(x, y, zoom, pixels int) layerBBox
+}
+
+// tileGrids are the grids tiles can be requested in with ?crs=.
+var tileGrids = map[string]tileGrid{
+	"EPSG:3857": {Columns: 1, bbox: func(x, y, zoom, pixels int) layerBBox {
+		return mercatorBBox(tileToBoundingBox(x, y, zoom), pixels)
+	}},
+	"EPSG:4326": {Columns: 2, bbox: func(x, y, zoom, pixels int) layerBBox {
+		return geographicBBox(geographicTileBounds(x, y, zoom), pixels)
+	}},
+}
+
+// wrapX normalizes a tile column modulo the grid's width at zoom, so
+// clients panning across the antimeridian keep getting valid tiles: in
+// EPSG:3857 at zoom 3, column 8 is column 0 and column -1 is column 7.
+func (g tileGrid) wrapX(x, zoom int) int {
+	n := g.Columns << zoom
+	return (x%n + n) % n
+}
+
+// geographicTileBounds returns the west, south, east, north extent in
+// degrees of a tile of the WGS84 grid, which is two tiles wide at zoom 0.
+func geographicTileBounds(x, y, zoom int) [4]float64 {
+	size := 180 / math.Exp2(float64(zoom))
+	west, north := -180+float64(x)*size, 90-float64(y)*size
+	return [4]float64{west, north - size, west + size, north}
+}
+
+// layerBBox returns the layer as it is requested for an extent, along with
+// the extent formatted as its BBOX.
+type layerBBox func(wms WMSInfo) (WMSInfo, string)
+
+// mercatorBBox requests an EPSG:3857 extent in each layer's own CRS.
+func mercatorBBox(m [4]float64, pixels int) layerBBox {
+	return func(wms WMSInfo) (WMSInfo, string) {
+		return wms, formatBBox(wms, m, pixels)
+	}
+}
+
+// geographicBBox requests a degree extent in EPSG:4326 whatever the layer's
+// CRS, so the image is in plate carrée.
+func geographicBBox(b [4]float64, pixels int) layerBBox {
+	return func(wms WMSInfo) (WMSInfo, string) {
+		wms.CRS = "EPSG:4326"
+		return wms, formatDegreesBBox(wms, b, pixels)
+	}
+}
+
+// wrapSegment is the part of an extent within one copy of the world:
+// Bounds is that part shifted back into the valid range, and X0 to X1 are
+// the pixel columns it covers.
+type wrapSegment struct {
+	Bounds [4]float64
+	X0, X1 int
+}
+
+// MAX_WRAPPED_WORLDS is how many copies of the world past each edge an
+// extent split by wrapSegments may reach into. Every copy shown costs more
+// upstream requests, so wider extents are clamped to this.
+const MAX_WRAPPED_WORLDS = 1
+
+// wrapSegments splits an EPSG:3857 extent width pixels wide at the
+// antimeridian, so that extents reaching past the world's edge, as at low
+// zoom, can be fetched piecewise and show the wrapped copies. Columns too
+// narrow to cover a pixel are dropped. Extents are clamped to
+// MAX_WRAPPED_WORLDS copies past each edge; non-finite and empty ones are
+// an error.
+func wrapSegments(m [4]float64, width int) ([]wrapSegment, error) {
+	for _, v := range m {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("invalid extent %v", m)
+		}
+	}
+	world := 2 * MERCATOR_EXTENT
+	limit := MERCATOR_EXTENT + MAX_WRAPPED_WORLDS*world
+	m[0], m[2] = max(m[0], -limit), min(m[2], limit)
+	span := m[2] - m[0]
+	if span <= 0 || width <= 0 {
+		return nil, fmt.Errorf("empty extent %v", m)
+	}
+	var segments []wrapSegment
+	for k := math.Floor((m[0] + MERCATOR_EXTENT) / world); k*world-MERCATOR_EXTENT < m[2]; k++ {
+		lo := max(m[0], k*world-MERCATOR_EXTENT)
+		hi := min(m[2], (k+1)*world-MERCATOR_EXTENT)
+		x0 := int(math.Round((lo - m[0]) / span * float64(width)))
+		x1 := int(math.Round((hi - m[0]) / span * float64(width)))
+		if x1 > x0 {
+			segments = append(segments, wrapSegment{[4]float64{lo - k*world, m[1], hi - k*world, m[3]}, x0, x1})
+		}
+	}
+	return segments, nil
+}
+
+// formatBBox formats a Web Mercator extent as a GetMap BBOX in the layer's
+// CRS for an image pixels wide.
+func formatBBox(wms WMSInfo, b [4]float64, pixels int) string {
+	if wms.crs() == "EPSG:4326" {
+		return formatDegreesBBox(wms, lonLatBounds(b), pixels)
+	}
+	return formatCoords(b, pixels)
+}
+
+// formatDegreesBBox formats a west, south, east, north extent in degrees
+// as an EPSG:4326 GetMap BBOX. WMS 1.3.0 orders the axes latitude first;
+// 1.1.1 keeps longitude first.
+func formatDegreesBBox(wms WMSInfo, b [4]float64, pixels int) string {
+	if wms.version() == "1.3.0" {
+		b = [4]float64{b[1], b[0], b[3], b[2]}
+	}
+	return formatCoords(b, pixels)
+}
+
+func formatCoords(b [4]float64, pixels int) string {
+	prec := bboxPrecision(math.Abs(b[2]-b[0]), pixels)
+	coords := make([]string, 4)
+	for i, v := range b {
+		coords[i] = strconv.FormatFloat(v, 'f', prec, 64)
+	}
+	return strings.Join(coords, ",")
+}
+
+// bboxPrecision returns the number of decimals to format BBOX coordinates
+// with: config.BBoxPrecision when set, otherwise just enough to resolve a
+// tenth of a pixel of an extent span units wide. That keeps high-zoom
+// degree extents exact without padding low-zoom meters with noise.
+func bboxPrecision(span float64, pixels int) int {
+	if config.BBoxPrecision >= 0 {
+		return config.BBoxPrecision
+	}
+	return max(0, int(math.Ceil(-math.Log10(span/float64(pixels)/10))))
+}
+
+// lonLatToTile returns the XYZ tile containing a WGS84 position at zoom.
+func lonLatToTile(lon, lat float64, zoom int) (x, y int) {
+	n := math.Exp2(float64(zoom))
+	latRad := lat * math.Pi / 180
+	x = int(math.Floor((lon + 180) / 360 * n))
+	y = int(math.Floor((1 - math.Log(math.Tan(latRad)+1/math.Cos(latRad))/math.Pi) / 2 * n))
+	last := int(n) - 1
+	return max(0, min(x, last)), max(0, min(y, last))
+}
@@ -0,0 +1,338 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestWrapSegments(t *testing.T) {
+	const size = TILE_SIZE
+	fetchSize := rotatedFetchSize(size)
+	tests := []struct {
+		name     string
+		m        [4]float64
+		width    int
+		segments int
+	}{
+		{"zoom 0 tile", tileToBoundingBox(0, 0, 0), size, 1},
+		{"zoom 0 rotated", bufferBounds(tileToBoundingBox(0, 0, 0), size), fetchSize, 3},
+		{"zoom 1 west rotated", bufferBounds(tileToBoundingBox(0, 0, 1), size), fetchSize, 2},
+		{"zoom 1 east rotated", bufferBounds(tileToBoundingBox(1, 1, 1), size), fetchSize, 2},
+		{"zoom 2 west rotated", bufferBounds(tileToBoundingBox(0, 1, 2), size), fetchSize, 2},
+		{"zoom 2 inner rotated", bufferBounds(tileToBoundingBox(1, 1, 2), size), fetchSize, 1},
+		{"zoom 2 east rotated", bufferBounds(tileToBoundingBox(3, 2, 2), size), fetchSize, 2},
+		{"past both edges", [4]float64{-3 * MERCATOR_EXTENT, -1, 3 * MERCATOR_EXTENT, 1}, 600, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			segments, err := wrapSegments(tt.m, tt.width)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(segments) != tt.segments {
+				t.Fatalf("got %d segments %+v, want %d", len(segments), segments, tt.segments)
+			}
+			metersPerPixel := (tt.m[2] - tt.m[0]) / float64(tt.width)
+			x := 0
+			for _, s := range segments {
+				if s.X0 != x || s.X1 <= s.X0 {
+					t.Errorf("segment %+v doesn't continue from column %d", s, x)
+				}
+				x = s.X1
+				b := s.Bounds
+				if b[0] < -MERCATOR_EXTENT-1e-6 || b[2] > MERCATOR_EXTENT+1e-6 || b[0] >= b[2] {
+					t.Errorf("segment bounds %v outside the world", b)
+				}
+				if b[1] != tt.m[1] || b[3] != tt.m[3] {
+					t.Errorf("segment bounds %v changed the extent's rows %v", b, tt.m)
+				}
+				if want := (b[2] - b[0]) / metersPerPixel; math.Abs(float64(s.X1-s.X0)-want) > 1 {
+					t.Errorf("segment %+v is %d columns, want about %.1f", s, s.X1-s.X0, want)
+				}
+			}
+			if x != tt.width {
+				t.Errorf("segments end at column %d, want %d", x, tt.width)
+			}
+		})
+	}
+}
+
+func TestWrapSegmentsInvalid(t *testing.T) {
+	inf, nan := math.Inf(1), math.NaN()
+	for _, m := range [][4]float64{
+		{-inf, -1, inf, 1},
+		{-inf, -1, 0, 1},
+		{0, -1, inf, 1},
+		{0, -inf, 1, inf},
+		{nan, -1, 1, 1},
+		{-1, -1, 1, nan},
+		{1, -1, 1, 1},
+		{1, -1, -1, 1},
+		// Entirely beyond the copies shown, so nothing is left.
+		{5 * MERCATOR_EXTENT, -1, 6 * MERCATOR_EXTENT, 1},
+	} {
+		if segments, err := wrapSegments(m, TILE_SIZE); err == nil {
+			t.Errorf("wrapSegments(%v) = %d segments, want error", m, len(segments))
+		}
+	}
+}
+
+func TestWrapSegmentsWide(t *testing.T) {
+	// /map?bbox=-1e7,0,1e7,10 and wider would otherwise fetch thousands of
+	// world copies.
+	west, _ := lonLatToMercator(-1e7, 0)
+	east, _ := lonLatToMercator(1e7, 0)
+	for _, m := range [][4]float64{
+		{west, -1, east, 1},
+		{-1e300, -1, 1e300, 1},
+		{-math.MaxFloat64, -1, math.MaxFloat64, 1},
+		{-1e300, -1, 0, 1},
+	} {
+		segments, err := wrapSegments(m, 1024)
+		if err != nil {
+			t.Fatalf("wrapSegments(%v): %v", m, err)
+		}
+		if most := 2*MAX_WRAPPED_WORLDS + 1; len(segments) > most {
+			t.Errorf("wrapSegments(%v) = %d segments, want at most %d", m, len(segments), most)
+		}
+		if last := segments[len(segments)-1]; segments[0].X0 != 0 || last.X1 != 1024 {
+			t.Errorf("wrapSegments(%v) covers columns %d to %d, want 0 to 1024", m, segments[0].X0, last.X1)
+		}
+	}
+}
+
+func TestWrapSegmentsZoom0Rotated(t *testing.T) {
+	// The buffered world tile shows the eastern edge at its left and the
+	// western edge at its right.
+	fetchSize := rotatedFetchSize(TILE_SIZE)
+	segments, err := wrapSegments(bufferBounds(tileToBoundingBox(0, 0, 0), TILE_SIZE), fetchSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) != 3 {
+		t.Fatalf("got %d segments, want 3", len(segments))
+	}
+	west, middle, east := segments[0], segments[1], segments[2]
+	if math.Abs(west.Bounds[2]-MERCATOR_EXTENT) > 1e-6 {
+		t.Errorf("left segment %v doesn't end at the eastern edge", west.Bounds)
+	}
+	if math.Abs(middle.Bounds[0]+MERCATOR_EXTENT) > 1e-6 || math.Abs(middle.Bounds[2]-MERCATOR_EXTENT) > 1e-6 {
+		t.Errorf("middle segment %v isn't the whole world", middle.Bounds)
+	}
+	if math.Abs(east.Bounds[0]+MERCATOR_EXTENT) > 1e-6 {
+		t.Errorf("right segment %v doesn't start at the western edge", east.Bounds)
+	}
+	if got := middle.X1 - middle.X0; got < TILE_SIZE-1 || got > TILE_SIZE+1 {
+		t.Errorf("middle segment is %d columns, want about %d", got, TILE_SIZE)
+	}
+	if d := (west.X1 - west.X0) - (east.X1 - east.X0); d < -1 || d > 1 {
+		t.Errorf("edge segments are %d and %d columns, want them equal", west.X1-west.X0, east.X1-east.X0)
+	}
+}
+
+func TestBBoxPrecision(t *testing.T) {
+	useConfig(t)
+	config.BBoxPrecision = -1
+	tests := []struct {
+		name   string
+		span   float64
+		pixels int
+		want   int
+	}{
+		{"meters zoom 0", 2 * 20037508.3427892, TILE_SIZE, 0},
+		{"meters zoom 12", 2 * 20037508.3427892 / (1 << 12), TILE_SIZE, 0},
+		{"meters zoom 20", 2 * 20037508.3427892 / (1 << 20), TILE_SIZE, 2},
+		{"meters zoom 20 @2x", 2 * 20037508.3427892 / (1 << 20), 2 * TILE_SIZE, 3},
+		{"degrees zoom 0", 360, TILE_SIZE, 1},
+		{"degrees zoom 12", 360.0 / (1 << 12), TILE_SIZE, 5},
+		{"degrees zoom 20", 360.0 / (1 << 20), TILE_SIZE, 7},
+	}
+	for _, tt := range tests {
+		if got := bboxPrecision(tt.span, tt.pixels); got != tt.want {
+			t.Errorf("%s: bboxPrecision(%g, %d) = %d, want %d", tt.name, tt.span, tt.pixels, got, tt.want)
+		}
+	}
+}
+
+func TestFormatCoordsHighZoom(t *testing.T) {
+	useConfig(t)
+	config.BBoxPrecision = -1
+	for _, z := range []int{16, 20, 22} {
+		x, y := lonLatToTile(-97.5, 35.4, z)
+		for _, degrees := range []bool{false, true} {
+			b := tileToBoundingBox(x, y, z)
+			if degrees {
+				b = lonLatBounds(b)
+			}
+			// Formatted coordinates are within a tenth of a pixel of the
+			// extent, so neighbouring tiles never share an edge value.
+			tenth := math.Abs(b[2]-b[0]) / TILE_SIZE / 10
+			for i, s := range strings.Split(formatCoords(b, TILE_SIZE), ",") {
+				v, err := strconv.ParseFloat(s, 64)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if math.Abs(v-b[i]) > tenth {
+					t.Errorf("z%d degrees %t: coordinate %d formatted %s, off %g from %v", z, degrees, i, s, math.Abs(v-b[i]), b[i])
+				}
+			}
+		}
+	}
+}
+
+func TestFormatCoordsOverride(t *testing.T) {
+	useConfig(t)
+	b := [4]float64{-10018754.171394622, 0.123456789, -9.87654321, 10018754.171394622}
+	tests := []struct {
+		precision int
+		want      string
+	}{
+		{-1, "-10018754,0,-10,10018754"},
+		{0, "-10018754,0,-10,10018754"},
+		{3, "-10018754.171,0.123,-9.877,10018754.171"},
+		{9, "-10018754.171394622,0.123456789,-9.876543210,10018754.171394622"},
+	}
+	for _, tt := range tests {
+		config.BBoxPrecision = tt.precision
+		if got := formatCoords(b, TILE_SIZE); got != tt.want {
+			t.Errorf("-bbox-precision %d: formatCoords = %s, want %s", tt.precision, got, tt.want)
+		}
+	}
+	// The override applies at any zoom, even where the automatic
+	// precision would need more decimals.
+	config.BBoxPrecision = 1
+	if got := bboxPrecision(360.0/(1<<20), TILE_SIZE); got != 1 {
+		t.Errorf("-bbox-precision 1 at zoom 20: %d decimals", got)
+	}
+}
+
+func TestWrapX(t *testing.T) {
+	grid := tileGrids["EPSG:3857"]
+	tests := []struct{ x, zoom, want int }{
+		{0, 0, 0},
+		{-1, 0, 0},
+		{1, 0, 0},
+		{7, 3, 7},
+		{8, 3, 0},
+		{-1, 3, 7},
+		{-8, 3, 0},
+		{-9, 3, 7},
+		{17, 3, 1},
+		{1024, 10, 0},
+		{-1, 10, 1023},
+		{-1, MAX_ZOOM, 1<<MAX_ZOOM - 1},
+	}
+	for _, tt := range tests {
+		if got := grid.wrapX(tt.x, tt.zoom); got != tt.want {
+			t.Errorf("wrapX(%d, %d) = %d, want %d", tt.x, tt.zoom, got, tt.want)
+		}
+	}
+}
+
+func TestAntimeridianTiles(t *testing.T) {
+	for _, z := range []int{0, 1, 3, 6, 10} {
+		n := 1 << z
+		for _, y := range []int{0, n / 2, n - 1} {
+			// Column -1 is the easternmost column and column n the
+			// westernmost, so panning past the antimeridian keeps going.
+			east, west := tileToBoundingBox(n-1, y, z), tileToBoundingBox(0, y, z)
+			if got := tileToBoundingBox(-1, y, z); got != east {
+				t.Errorf("z%d y%d: column -1 = %v, want %v", z, y, got, east)
+			}
+			if got := tileToBoundingBox(n, y, z); got != west {
+				t.Errorf("z%d y%d: column %d = %v, want %v", z, y, n, got, west)
+			}
+			if math.Abs(east[2]-MERCATOR_EXTENT) > 1e-6 || math.Abs(west[0]+MERCATOR_EXTENT) > 1e-6 {
+				t.Errorf("z%d y%d: edge columns span %g to %g, want the antimeridian", z, y, west[0], east[2])
+			}
+			for _, b := range [][4]float64{east, west} {
+				for _, v := range b {
+					if math.Abs(v) > MERCATOR_EXTENT {
+						t.Errorf("z%d y%d: extent %v leaves the world", z, y, b)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestPacificTiles(t *testing.T) {
+	places := []struct {
+		name     string
+		lon, lat float64
+	}{
+		{"guam", 144.8, 13.4},
+		{"western aleutians", 173.2, 52.9},
+		{"eastern aleutians", -176.6, 51.9},
+	}
+	for _, p := range places {
+		for _, z := range []int{3, 6, 9} {
+			x, y := lonLatToTile(p.lon, p.lat, z)
+			b := lonLatBounds(tileToBoundingBox(x, y, z))
+			if p.lon < b[0] || p.lon > b[2] || p.lat < b[1] || p.lat > b[3] {
+				t.Errorf("%s z%d: tile %d/%d spans %v", p.name, z, x, y, b)
+			}
+			// A client that keeps counting columns past either edge gets
+			// the same tile.
+			for _, wrapped := range []int{x - 1<<z, x + 1<<z} {
+				if got := lonLatBounds(tileToBoundingBox(wrapped, y, z)); got != b {
+					t.Errorf("%s z%d: column %d spans %v, want %v", p.name, z, wrapped, got, b)
+				}
+			}
+		}
+	}
+}
+
+func TestGeographicGrid(t *testing.T) {
+	useConfig(t)
+	config.BBoxPrecision = -1
+	grid := tileGrids["EPSG:4326"]
+	// The grid is two tiles wide at zoom 0, so it wraps at twice the
+	// Web Mercator width.
+	for _, tt := range []struct{ x, zoom, want int }{{2, 0, 0}, {-1, 0, 1}, {3, 1, 3}, {4, 1, 0}, {-1, 3, 15}} {
+		if got := grid.wrapX(tt.x, tt.zoom); got != tt.want {
+			t.Errorf("EPSG:4326 wrapX(%d, %d) = %d, want %d", tt.x, tt.zoom, got, tt.want)
+		}
+	}
+	if got, want := geographicTileBounds(0, 0, 0), [4]float64{-180, -90, 0, 90}; got != want {
+		t.Errorf("EPSG:4326 0/0/0 = %v, want %v", got, want)
+	}
+	if got, want := geographicTileBounds(3, 1, 1), [4]float64{90, -90, 180, 0}; got != want {
+		t.Errorf("EPSG:4326 1/3/1 = %v, want %v", got, want)
+	}
+
+	// Every layer is asked for the tile in EPSG:4326, latitude first in
+	// WMS 1.3.0 and longitude first in 1.1.1.
+	bbox := grid.bbox(3, 1, 1, TILE_SIZE)
+	for _, tt := range []struct {
+		wms  WMSInfo
+		want string
+	}{
+		{WMSInfo{}, "-90.00,90.00,0.00,180.00"},
+		{WMSInfo{CRS: "EPSG:3857"}, "-90.00,90.00,0.00,180.00"},
+		{WMSInfo{Version: "1.1.1"}, "90.00,-90.00,180.00,0.00"},
+	} {
+		wms, got := bbox(tt.wms)
+		if wms.crs() != "EPSG:4326" || got != tt.want {
+			t.Errorf("%s layer in WMS %s: %s %s, want EPSG:4326 %s", tt.wms.crs(), tt.wms.version(), wms.crs(), got, tt.want)
+		}
+	}
+}
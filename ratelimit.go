@@ -0,0 +1,244 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// --- Rate Limiting ---
+
+// rateClasses are the endpoint classes that can be limited independently,
+// since a tile costs far less to serve than a composite.
+var rateClasses = []string{"tiles", "frames", "map", "composite"}
+
+// RATE_LIMITER_IDLE is how long a client's limiter is kept after its last
+// request.
+const RATE_LIMITER_IDLE = 10 * time.Minute
+
+// classLimit is the requests per second allowed per client IP in an
+// endpoint class, and the burst of requests allowed at once.
+type classLimit struct {
+	Rate  float64
+	Burst int
+}
+
+// rateLimits holds the limit of each endpoint class, parsed from
+// config.RateLimits. Classes without an entry are unlimited.
+var rateLimits = make(map[string]classLimit)
+
+// parseRateLimits parses a comma-separated list of class=rate pairs, each
+// optionally followed by :burst. The burst defaults to one second's worth
+// of requests.
+func parseRateLimits(s string) (map[string]classLimit, error) {
+	limits := make(map[string]classLimit)
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		class, value, ok := strings.Cut(pair, "=")
+		if !ok || !slices.Contains(rateClasses, class) {
+			return nil, fmt.Errorf("expected class=rate[:burst] with class one of %s, got %q", strings.Join(rateClasses, ", "), pair)
+		}
+		value, burstValue, hasBurst := strings.Cut(value, ":")
+		limit, err := strconv.ParseFloat(value, 64)
+		if err != nil || limit <= 0 || math.IsInf(limit, 0) {
+			return nil, fmt.Errorf("invalid rate %q for %s", value, class)
+		}
+		burst := max(1, int(math.Ceil(limit)))
+		if hasBurst {
+			if burst, err = strconv.Atoi(burstValue); err != nil || burst < 1 {
+				return nil, fmt.Errorf("invalid burst %q for %s", burstValue, class)
+			}
+		}
+		limits[class] = classLimit{Rate: limit, Burst: burst}
+	}
+	return limits, nil
+}
+
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+var (
+	limiters      = make(map[string]map[string]*clientLimiter)
+	limitersMutex = &sync.Mutex{}
+)
+
+// getClientLimiter returns the token bucket for an IP in an endpoint class,
+// creating it on first use.
+func getClientLimiter(class, ip string, limit classLimit) *rate.Limiter {
+	limitersMutex.Lock()
+	defer limitersMutex.Unlock()
+	clients, ok := limiters[class]
+	if !ok {
+		clients = make(map[string]*clientLimiter)
+		limiters[class] = clients
+	}
+	c, ok := clients[ip]
+	if !ok {
+		c = &clientLimiter{limiter: rate.NewLimiter(rate.Limit(limit.Rate), limit.Burst)}
+		clients[ip] = c
+	}
+	c.lastSeen = time.Now()
+	return c.limiter
+}
+
+// runLimiterSweep forgets limiters of clients that have gone quiet, so the
+// maps do not grow with every address ever seen.
+func runLimiterSweep(ctx context.Context) {
+	for sleepContext(ctx, RATE_LIMITER_IDLE/2) {
+		limitersMutex.Lock()
+		for _, clients := range limiters {
+			for ip, c := range clients {
+				if time.Since(c.lastSeen) > RATE_LIMITER_IDLE {
+					delete(clients, ip)
+				}
+			}
+		}
+		limitersMutex.Unlock()
+	}
+}
+
+// trustedProxies are the reverse proxies whose X-Forwarded-For is
+// believed, parsed from config.TrustedProxies.
+var trustedProxies []netip.Prefix
+
+// parseTrustedProxies parses a comma-separated list of CIDR prefixes or
+// single addresses.
+func parseTrustedProxies(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(s, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(entry); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address or prefix %q", entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func trustedProxy(addr netip.Addr) bool {
+	return slices.ContainsFunc(trustedProxies, func(p netip.Prefix) bool { return p.Contains(addr.Unmap()) })
+}
+
+// clientIP returns the address a request came from. Behind trusted
+// proxies that is the last X-Forwarded-For hop before them, since clients
+// can put anything in the header themselves.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil || !trustedProxy(addr) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		if addr = hop; !trustedProxy(hop) {
+			break
+		}
+	}
+	return addr.String()
+}
+
+// rateLimit wraps a handler with the per-client limit of its endpoint
+// class. Requests over the limit get 429 with a Retry-After telling the
+// client when a token will be available.
+func rateLimit(class string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		limit, ok := rateLimits[class]
+		if !ok {
+			next(w, r)
+			return
+		}
+		reservation := getClientLimiter(class, clientIP(r), limit).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			reservation.Cancel()
+			setRetryAfter(w, delay)
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// --- Upstream Concurrency ---
+
+// upstreamSlots bounds the GetMap requests in flight across all clients,
+// sized by config.MaxUpstreamRequests. It is nil when unbounded.
+var upstreamSlots chan struct{}
+
+// upstreamSlot is a place in upstreamSlots that can be given up and taken
+// again, as retries do while they back off. A nil slot does nothing.
+type upstreamSlot struct {
+	held bool
+}
+
+// acquireUpstream waits for an upstream slot, or returns ctx's error if ctx
+// is done first.
+func acquireUpstream(ctx context.Context) (*upstreamSlot, error) {
+	slot := &upstreamSlot{}
+	return slot, slot.acquire(ctx)
+}
+
+// acquire takes the slot again after release.
+func (s *upstreamSlot) acquire(ctx context.Context) error {
+	if s == nil || s.held || upstreamSlots == nil {
+		return nil
+	}
+	select {
+	case upstreamSlots <- struct{}{}:
+		s.held = true
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release gives up the slot if it is held.
+func (s *upstreamSlot) release() {
+	if s != nil && s.held {
+		<-upstreamSlots
+		s.held = false
+	}
+}
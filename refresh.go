@@ -0,0 +1,68 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand/v2"
+	"slices"
+	"time"
+)
+
+// --- Background Refresh ---
+
+// activeAreas returns the areas requested within the idle window, sorted so
+// each refresh cycle staggers them in a stable order.
+func activeAreas(idle time.Duration) []string {
+	accessMutex.Lock()
+	defer accessMutex.Unlock()
+	var areas []string
+	for area, at := range lastAccess {
+		if time.Since(at) <= idle {
+			areas = append(areas, area)
+		}
+	}
+	slices.Sort(areas)
+	return areas
+}
+
+// runRefresher refreshes active areas' timestamps before they expire.
+// Refreshes are spread evenly across each cycle with some jitter instead of
+// firing together, so GetCapabilities calls never arrive at NOAA in a burst.
+// A cycle is half the cache lifetime, which keeps every active area fresh
+// even with the jitter.
+func runRefresher(ctx context.Context) {
+	interval := config.CacheTTL / 2
+	for {
+		cycleStart := time.Now()
+		areas := activeAreas(config.RefreshIdle)
+		for i, area := range areas {
+			slot := interval / time.Duration(len(areas))
+			offset := slot*time.Duration(i) + rand.N(slot/2+1)
+			if !sleepContext(ctx, time.Until(cycleStart.Add(offset))) {
+				return
+			}
+			if _, err := fetchTimestamps(ctx, area); err != nil {
+				log.Printf("Background refresh of '%s' failed: %v", area, err)
+			}
+		}
+		if !sleepContext(ctx, time.Until(cycleStart.Add(interval))) {
+			return
+		}
+	}
+}
@@ -0,0 +1,64 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"net/http"
+	"regexp"
+)
+
+// --- Request IDs ---
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	forwardedHeadersKey
+)
+
+// validRequestID limits incoming X-Request-ID values to a safe length and
+// character set, since they are echoed in headers and written to logs.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestID returns the request ID stored in ctx, if any.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// setRequestIDHeader forwards ctx's request ID on an upstream request.
+func setRequestIDHeader(ctx context.Context, req *http.Request) {
+	if id := requestID(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+}
+
+// withRequestID reuses a valid incoming X-Request-ID or generates a new one,
+// echoes it in the response and stores it in the request context so it is
+// forwarded upstream and can be logged.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id = rand.Text()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
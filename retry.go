@@ -0,0 +1,100 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// --- Upstream Retries ---
+
+var promUpstreamRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "wmsproxy_upstream_retries_total",
+	Help: "Upstream requests retried after a transient failure, by area and request type.",
+}, []string{"area", "request"})
+
+// errEmptyResponse reports a 200 response without a body, which NOAA sends
+// during partial outages.
+var errEmptyResponse = errors.New("upstream returned an empty response")
+
+// doWithRetry sends the request built by newRequest, retrying network
+// errors, 5xx responses and empty 200 responses up to -upstream-attempts
+// times in total with exponential backoff and jitter. 4xx responses are
+// returned at once, and retries stop when ctx is done. A fresh request is
+// built for each attempt since a POST body can only be read once. The
+// upstream slot, if any, is given up while backing off.
+func doWithRetry(ctx context.Context, area, request string, slot *upstreamSlot, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := client.Do(req)
+		if err == nil && resp.StatusCode == http.StatusOK && emptyBody(resp) {
+			resp.Body.Close()
+			resp, err = nil, errEmptyResponse
+		}
+		transient := err != nil || resp.StatusCode >= 500
+		if !transient || attempt >= config.UpstreamAttempts || ctx.Err() != nil {
+			return resp, err
+		}
+
+		var reason string
+		if err == nil {
+			reason = resp.Status
+			resp.Body.Close()
+		} else {
+			reason = err.Error()
+		}
+		delay := config.UpstreamRetryDelay<<(attempt-1) + rand.N(config.UpstreamRetryDelay+1)
+		slog.DebugContext(ctx, fmt.Sprintf("Retrying %s for '%s' in %v after attempt %d failed: %s", request, area, delay.Round(time.Millisecond), attempt, reason))
+		promUpstreamRetries.WithLabelValues(area, request).Inc()
+		slot.release()
+		if !sleepContext(ctx, delay) {
+			return nil, ctx.Err()
+		}
+		if err := slot.acquire(ctx); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// emptyBody reports whether resp has no body, peeking at the first byte
+// when the length isn't declared. The peeked byte stays readable.
+func emptyBody(resp *http.Response) bool {
+	if resp.ContentLength >= 0 {
+		return resp.ContentLength == 0
+	}
+	br := bufio.NewReader(resp.Body)
+	_, err := br.Peek(1)
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, resp.Body}
+	return err == io.EOF
+}
@@ -0,0 +1,105 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// emptyThenPNG is a WMS server that answers its first empty requests with
+// an empty 200, flushed without a length when chunked is set, and a PNG
+// after that.
+func emptyThenPNG(t *testing.T, empty int32, chunked bool) (*httptest.Server, *atomic.Int32) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, TILE_SIZE, TILE_SIZE))); err != nil {
+		t.Fatal(err)
+	}
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) <= empty {
+			if chunked {
+				w.(http.Flusher).Flush()
+			}
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(buf.Bytes())
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestRetryEmptyResponse(t *testing.T) {
+	useConfig(t)
+	config.UpstreamAttempts = 3
+	config.UpstreamRetryDelay = 0
+	for _, chunked := range []bool{false, true} {
+		srv, requests := emptyThenPNG(t, 1, chunked)
+		resp, err := doWithRetry(context.Background(), "conus", "GetMap", nil, func() (*http.Request, error) {
+			return http.NewRequest(http.MethodGet, srv.URL, nil)
+		})
+		if err != nil {
+			t.Fatalf("chunked=%t: %v", chunked, err)
+		}
+		resp.Body.Close()
+		if got := requests.Load(); got != 2 {
+			t.Errorf("chunked=%t: %d requests, want 2", chunked, got)
+		}
+	}
+}
+
+func TestEmptyResponseServesBlankTile(t *testing.T) {
+	useConfig(t)
+	config.UpstreamAttempts = 2
+	config.UpstreamRetryDelay = 0
+	srv, requests := emptyThenPNG(t, 100, false)
+	useLayer(t, "conus", WMSInfo{URL: srv.URL, LayerName: "conus_bref_qcd"})
+
+	_, err := doWithRetry(context.Background(), "conus", "GetMap", nil, func() (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, srv.URL, nil)
+	})
+	if !errors.Is(err, errEmptyResponse) {
+		t.Fatalf("doWithRetry error = %v, want errEmptyResponse", err)
+	}
+
+	requests.Store(0)
+	result, status, err := tileBytes(context.Background(), testTile("conus"))
+	if err != nil || status != http.StatusOK {
+		t.Fatalf("tileBytes = %d, %v", status, err)
+	}
+	if !result.Negative {
+		t.Error("tile from empty responses isn't marked negative")
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("%d upstream requests, want 2", got)
+	}
+	img, err := png.Decode(bytes.NewReader(result.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fullyTransparent(img) {
+		t.Error("blank tile isn't fully transparent")
+	}
+}
@@ -0,0 +1,91 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"image"
+	"image/color"
+)
+
+// --- Thermal Printer Output ---
+
+// THERMAL_WIDTH is the default image width for thermal printers, the dot
+// count of common 58mm print heads.
+const THERMAL_WIDTH = 384
+
+// thermalPalette is the 1-bit palette of thermal output. The PNG encoder
+// writes two-colour paletted images at 1 bit per pixel.
+var thermalPalette = color.Palette{color.White, color.Black}
+
+// thermalDarkness maps a radar pixel to how densely it should be printed:
+// 0 for no echo up to 1 for the strongest reflectivity bucket.
+func thermalDarkness(colors *colormapLookup, c color.Color) float64 {
+	i := colors.index(c)
+	if i < 0 {
+		return 0
+	}
+	return float64(i+1) / float64(len(reflectivityColormap))
+}
+
+// ditherThermal converts radar to a 1-bit image whose dot density follows
+// reflectivity, diffusing each pixel's quantization error to its
+// neighbours with Floyd-Steinberg weights.
+func ditherThermal(img image.Image) *image.Paletted {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// Two rows of accumulated darkness: the current row and the next.
+	cur, next := make([]float64, w+2), make([]float64, w+2)
+	out := image.NewPaletted(b, thermalPalette)
+	colors := newColormapLookup()
+	defer colors.done()
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := cur[x+1] + thermalDarkness(colors, img.At(b.Min.X+x, b.Min.Y+y))
+			var q float64
+			if v >= 0.5 {
+				q = 1
+				out.SetColorIndex(b.Min.X+x, b.Min.Y+y, 1)
+			}
+			e := v - q
+			cur[x+2] += e * 7 / 16
+			next[x] += e * 3 / 16
+			next[x+1] += e * 5 / 16
+			next[x+2] += e * 1 / 16
+		}
+		cur, next = next, cur
+		clear(next)
+	}
+	return out
+}
+
+// thresholdMono reduces an image to the thermal palette by luminance,
+// treating transparency as paper. It keeps annotations drawn over a
+// dithered image 1-bit without dithering them again.
+func thresholdMono(img image.Image) *image.Paletted {
+	b := img.Bounds()
+	out := image.NewPaletted(b, thermalPalette)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			g := color.GrayModel.Convert(img.At(x, y)).(color.Gray)
+			_, _, _, a := img.At(x, y).RGBA()
+			if a >= 0x8000 && g.Y < 0x80 {
+				out.SetColorIndex(x, y, 1)
+			}
+		}
+	}
+	return out
+}
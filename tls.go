@@ -0,0 +1,61 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// --- TLS Serving ---
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig builds the server TLS settings from config. Only cipher suites
+// Go considers secure may be selected; TLS 1.3 suites are not configurable.
+func tlsConfig() (*tls.Config, error) {
+	if config.TLSCert == "" || config.TLSKey == "" {
+		return nil, fmt.Errorf("both -tls-cert and -tls-key are required")
+	}
+	minVersion, ok := tlsVersions[config.TLSMinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS version %q", config.TLSMinVersion)
+	}
+	cfg := &tls.Config{MinVersion: minVersion}
+
+	if config.TLSCiphers != "" {
+		secure := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			secure[suite.Name] = suite.ID
+		}
+		for _, name := range strings.Split(config.TLSCiphers, ",") {
+			name = strings.TrimSpace(name)
+			id, ok := secure[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+	return cfg, nil
+}
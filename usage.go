@@ -0,0 +1,147 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- API Keys and Usage Accounting ---
+
+// apiKey is a client credential and the identity usage is accounted under.
+type apiKey struct {
+	Name string
+	Key  string
+}
+
+var apiKeys []apiKey
+
+// parseAPIKeys parses a comma-separated list of name:key pairs.
+func parseAPIKeys(s string) ([]apiKey, error) {
+	var keys []apiKey
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		name, key, ok := strings.Cut(pair, ":")
+		if !ok || name == "" || key == "" {
+			return nil, fmt.Errorf("expected name:key, got %q", pair)
+		}
+		keys = append(keys, apiKey{Name: name, Key: key})
+	}
+	return keys, nil
+}
+
+// lookupAPIKey returns the name of the client holding key.
+func lookupAPIKey(key string) (string, bool) {
+	for _, k := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(k.Key)) == 1 {
+			return k.Name, true
+		}
+	}
+	return "", false
+}
+
+var (
+	usageCounts = make(map[string]int64)
+	usageSince  = time.Now()
+	usageMutex  = &sync.Mutex{}
+)
+
+// recordUsage counts a request against a client and reports whether it is
+// within the client's quota for the current period.
+func recordUsage(name string) bool {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	usageCounts[name]++
+	return config.APIKeyQuota <= 0 || usageCounts[name] <= config.APIKeyQuota
+}
+
+// usagePeriodLeft returns how long until the current accounting period
+// ends and quotas are replenished.
+func usagePeriodLeft() time.Duration {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	return max(time.Until(usageSince.Add(config.UsageReset)), 0)
+}
+
+// resetUsage clears every client's counter, starting a new period.
+func resetUsage() {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+	clear(usageCounts)
+	usageSince = time.Now()
+}
+
+// runUsageReset starts a new accounting period every config.UsageReset.
+func runUsageReset(ctx context.Context) {
+	for sleepContext(ctx, config.UsageReset) {
+		resetUsage()
+		log.Printf("API key usage counters reset")
+	}
+}
+
+// requireAPIKey wraps a handler so that, when API keys are configured, it
+// only runs for requests carrying a known key in the X-API-Key header or
+// the key query parameter. Each request is accounted to the key's client.
+func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(apiKeys) == 0 {
+			next(w, r)
+			return
+		}
+		key := r.Header.Get("X-API-Key")
+		if key == "" {
+			key = r.URL.Query().Get("key")
+		}
+		name, ok := lookupAPIKey(key)
+		if !ok {
+			http.Error(w, "invalid or missing API key", http.StatusUnauthorized)
+			return
+		}
+		if !recordUsage(name) {
+			setRetryAfter(w, usagePeriodLeft())
+			http.Error(w, "API key quota exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// usageHandler serves /admin/usage, the request counts per client for the
+// current accounting period. The counts are copied before encoding, so a
+// slow client does not hold up the requests being counted.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	usageMutex.Lock()
+	body := map[string]any{
+		"since":  usageSince.UTC().Format(time.RFC3339),
+		"quota":  config.APIKeyQuota,
+		"counts": maps.Clone(usageCounts),
+	}
+	usageMutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,111 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// useAPIKeys configures keys and fresh usage counters for the duration of t.
+func useAPIKeys(t *testing.T, keys ...apiKey) {
+	saved := apiKeys
+	apiKeys = keys
+	resetUsage()
+	t.Cleanup(func() {
+		apiKeys = saved
+		resetUsage()
+	})
+}
+
+func TestAPIKeyQuotaRetryAfter(t *testing.T) {
+	useConfig(t)
+	config.APIKeyQuota = 2
+	config.UsageReset = time.Hour
+	config.RetryJitter = 0
+	useAPIKeys(t, apiKey{Name: "watch", Key: "secret"})
+	handler := requireAPIKey(func(w http.ResponseWriter, r *http.Request) {})
+
+	for i := range 3 {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/tiles/5/8/12.png", nil)
+		req.Header.Set("X-API-Key", "secret")
+		handler(rec, req)
+		if i < 2 {
+			if rec.Code != http.StatusOK {
+				t.Fatalf("request %d within quota: status %d", i+1, rec.Code)
+			}
+			continue
+		}
+		if rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("request over quota: status %d, want 429", rec.Code)
+		}
+		retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+		if err != nil || retryAfter < 3590 || retryAfter > 3600 {
+			t.Errorf("Retry-After = %q, want the hour left in the period", rec.Header().Get("Retry-After"))
+		}
+	}
+}
+
+// stalledWriter is a ResponseWriter whose Write blocks until release is
+// closed, like a client that stopped reading.
+type stalledWriter struct {
+	*httptest.ResponseRecorder
+	writing chan struct{}
+	release chan struct{}
+}
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	close(w.writing)
+	<-w.release
+	return w.ResponseRecorder.Write(p)
+}
+
+func TestUsageHandlerStalledClient(t *testing.T) {
+	useConfig(t)
+	useAPIKeys(t, apiKey{Name: "watch", Key: "secret"})
+	recordUsage("watch")
+
+	w := &stalledWriter{httptest.NewRecorder(), make(chan struct{}), make(chan struct{})}
+	done := make(chan struct{})
+	go func() {
+		usageHandler(w, httptest.NewRequest(http.MethodGet, "/admin/usage", nil))
+		close(done)
+	}()
+	<-w.writing
+
+	// Requests are still counted while the usage report is being written.
+	counted := make(chan struct{})
+	go func() {
+		recordUsage("watch")
+		close(counted)
+	}()
+	select {
+	case <-counted:
+	case <-time.After(5 * time.Second):
+		t.Error("recordUsage blocked behind a stalled /admin/usage client")
+	}
+	close(w.release)
+	<-done
+	if body := w.Body.String(); body == "" || !json.Valid([]byte(body)) {
+		t.Errorf("usage report %q is not JSON", body)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+   Copyright 2025 blockarchitech
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// --- Cache Warm-Up ---
+
+// warmTiles are the tiles rendered into the cache at startup, parsed from
+// config.WarmTiles.
+var warmTiles []tileRequest
+
+// parseWarmTiles parses a comma-separated list of area/z/x/y tiles.
+func parseWarmTiles(list string) ([]tileRequest, error) {
+	var tiles []tileRequest
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, "/")
+		if len(parts) != 4 {
+			return nil, fmt.Errorf("invalid tile %q: expected area/z/x/y", entry)
+		}
+		wms, ok := radarLayers[parts[0]]
+		if !ok {
+			return nil, fmt.Errorf("invalid area: %s", parts[0])
+		}
+		var coords [3]int
+		for i, part := range parts[1:] {
+			n, err := strconv.Atoi(part)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tile %q: bad coordinate %q", entry, part)
+			}
+			coords[i] = n
+		}
+		z, x, y := coords[0], coords[1], coords[2]
+		if z < 0 || z > MAX_ZOOM || x < 0 || x >= 1<<z || y < 0 || y >= 1<<z {
+			return nil, fmt.Errorf("invalid tile %q: out of range", entry)
+		}
+		tile := plainTile(parts[0], z, x, y)
+		tile.Alerts = wms.DefaultAlerts
+		tiles = append(tiles, tile)
+	}
+	return tiles, nil
+}
+
+// runWarmUp renders warmTiles at each area's latest frame into the tile
+// cache, so the most requested tiles are fast right after a deploy. It
+// runs once, alongside serving.
+func runWarmUp(ctx context.Context) {
+	byArea := make(map[string][]tileRequest)
+	for _, tile := range warmTiles {
+		byArea[tile.Area] = append(byArea[tile.Area], tile)
+	}
+	for _, area := range slices.Sorted(maps.Keys(byArea)) {
+		timestamps, err := getTimestamps(ctx, area)
+		if err != nil || len(timestamps) == 0 {
+			log.Printf("Cache warm-up of '%s' skipped: could not get latest timestamp: %v", area, err)
+			continue
+		}
+		set := tileSet{Area: area, Time: timestamps[len(timestamps)-1], Tiles: byArea[area]}
+		if err := renderTileSet(ctx, set, func(tileRequest, []byte) error { return nil }); err != nil {
+			log.Printf("Cache warm-up of '%s' incomplete: %v", area, err)
+		}
+	}
+	log.Printf("Cache warm-up finished")
+}